@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Write file atomic writes r to path through a temporary file in the same
+// directory that is moved into place only once fully written, so readers never
+// see a partial file. With noClobber set it fails with an os.ErrExist error
+// instead of replacing an existing file. It returns the number of bytes written.
+func writeFileAtomic(path string, r io.Reader, noClobber bool) (int64, error) {
+	// Hidden so the temporary file stays out of directory listings
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	tempPath := temp.Name()
+	defer os.Remove(tempPath)
+	
+	size, err := io.Copy(temp, r)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0644)
+	}
+	if err != nil {
+		return size, err
+	}
+	
+	// A hard link can't replace an existing file, which makes creation race-free;
+	// the deferred Remove then drops the temporary name
+	if noClobber {
+		return size, os.Link(tempPath, path)
+	}
+	return size, os.Rename(tempPath, path)
+}
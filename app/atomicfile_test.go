@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingReader yields its data and then fails, like a client dropping mid-upload
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestWriteFileAtomicReaderError(t *testing.T) {
+	for _, noClobber := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "file.txt")
+		if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		
+		broken := errors.New("connection reset")
+		r := &failingReader{data: strings.NewReader(strings.Repeat("partial ", 10000)), err: broken}
+		if _, err := writeFileAtomic(path, r, noClobber); !errors.Is(err, broken) {
+			t.Errorf("noClobber=%v: error = %v, want %v", noClobber, err, broken)
+		}
+		
+		if data, err := os.ReadFile(path); err != nil || string(data) != "original" {
+			t.Errorf("noClobber=%v: file holds %q (%v), want the original", noClobber, data, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			t.Errorf("noClobber=%v: directory holds %v, want only file.txt", noClobber, names)
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	
+	size, err := writeFileAtomic(path, strings.NewReader("first"), true)
+	if err != nil || size != 5 {
+		t.Fatalf("create: size %d, error %v", size, err)
+	}
+	if _, err := writeFileAtomic(path, strings.NewReader("second"), true); !errors.Is(err, os.ErrExist) {
+		t.Errorf("noClobber over an existing file: error = %v, want os.ErrExist", err)
+	}
+	if _, err := writeFileAtomic(path, strings.NewReader("third"), false); err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "third" {
+		t.Errorf("file holds %q, want third", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want 1", len(entries))
+	}
+}
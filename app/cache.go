@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// FileCache keeps the contents of recently served files in memory, up to a byte
+// budget, evicting the least recently used files first. Entries are keyed by path
+// and remember the ETag they were read under, so a file that has changed on disk
+// since is read again. A nil cache is valid and caches nothing.
+type FileCache struct {
+	maxBytes int64
+	size     int64
+	// order holds *cacheEntry values, most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+	mutex   sync.Mutex
+	// hits, misses and evictions are reported on /metrics
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// cacheEntry is a cached file's content along with what is needed to serve it
+type cacheEntry struct {
+	path        string
+	etag        string
+	content     []byte
+	contentType string
+}
+
+// NewFileCache creates a cache holding at most maxBytes of file content
+func NewFileCache(maxBytes int64) *FileCache {
+	return &FileCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns a file's cached content and content type if it was cached under
+// the same ETag. An entry with a different ETag is stale and is dropped.
+func (c *FileCache) Get(path string, etag string) ([]byte, string, bool) {
+	if c == nil {
+		return nil, "", false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	element, ok := c.entries[path]
+	if !ok {
+		c.misses.Add(1)
+		return nil, "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.etag != etag {
+		c.remove(element)
+		c.misses.Add(1)
+		return nil, "", false
+	}
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return entry.content, entry.contentType, true
+}
+
+// Fits reports whether a file of the given size can be cached at all
+func (c *FileCache) Fits(size int64) bool {
+	return c != nil && size <= c.maxBytes
+}
+
+// Put caches a file's content, evicting the least recently used files until it fits
+func (c *FileCache) Put(path string, etag string, content []byte, contentType string) {
+	if !c.Fits(int64(len(content))) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+	for c.size+int64(len(content)) > c.maxBytes {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+	c.entries[path] = c.order.PushFront(&cacheEntry{
+		path:        path,
+		etag:        etag,
+		content:     content,
+		contentType: contentType,
+	})
+	c.size += int64(len(content))
+}
+
+// Invalidate drops the entry for a file, or for every file under a directory,
+// once they are gone from disk
+func (c *FileCache) Invalidate(path string) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	
+	prefix := path + string(filepath.Separator)
+	for cached, element := range c.entries {
+		if cached == path || strings.HasPrefix(cached, prefix) {
+			c.remove(element)
+		}
+	}
+}
+
+// Remove drops an entry; the caller must hold the mutex
+func (c *FileCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.path)
+	c.size -= int64(len(entry.content))
+}
+
+// Write prometheus renders the cache's counters alongside the server metrics
+func (c *FileCache) writePrometheus(buf *bytes.Buffer) {
+	c.mutex.Lock()
+	size := c.size
+	c.mutex.Unlock()
+	
+	buf.WriteString("# HELP http_file_cache_hits_total File reads served from the in-memory cache.\n")
+	buf.WriteString("# TYPE http_file_cache_hits_total counter\n")
+	fmt.Fprintf(buf, "http_file_cache_hits_total %d\n", c.hits.Load())
+	
+	buf.WriteString("# HELP http_file_cache_misses_total File reads that went to disk, including stale entries.\n")
+	buf.WriteString("# TYPE http_file_cache_misses_total counter\n")
+	fmt.Fprintf(buf, "http_file_cache_misses_total %d\n", c.misses.Load())
+	
+	buf.WriteString("# HELP http_file_cache_evictions_total Files evicted to stay within the cache budget.\n")
+	buf.WriteString("# TYPE http_file_cache_evictions_total counter\n")
+	fmt.Fprintf(buf, "http_file_cache_evictions_total %d\n", c.evictions.Load())
+	
+	buf.WriteString("# HELP http_file_cache_bytes Bytes of file content currently cached.\n")
+	buf.WriteString("# TYPE http_file_cache_bytes gauge\n")
+	fmt.Fprintf(buf, "http_file_cache_bytes %d\n", size)
+}
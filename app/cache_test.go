@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileCacheInvalidate(t *testing.T) {
+	c := NewFileCache(1024)
+	paths := []string{
+		filepath.Join("files", "dir", "a.txt"),
+		filepath.Join("files", "dir", "sub", "b.txt"),
+		filepath.Join("files", "dir2", "c.txt"),
+		filepath.Join("files", "dir.txt"),
+	}
+	for _, path := range paths {
+		c.Put(path, "etag", []byte("content"), "text/plain")
+	}
+	
+	c.Invalidate(filepath.Join("files", "dir"))
+	for i, path := range paths {
+		_, _, ok := c.Get(path, "etag")
+		if want := i >= 2; ok != want {
+			t.Errorf("%s cached = %v, want %v", path, ok, want)
+		}
+	}
+	if c.size != int64(2*len("content")) {
+		t.Errorf("size = %d after invalidating, want %d", c.size, 2*len("content"))
+	}
+	
+	c.Invalidate(filepath.Join("files", "dir.txt"))
+	if _, _, ok := c.Get(filepath.Join("files", "dir.txt"), "etag"); ok {
+		t.Error("file still cached after invalidating it")
+	}
+}
+
+func TestRecursiveDeleteInvalidatesCache(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{CacheBytes: 1024})
+	dir := filepath.Join(s.config.Directory, "files", "dir", "sub")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		resp := roundTrip(t, s, "GET /files/dir/sub/"+name+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != 200 {
+			t.Fatalf("GET %s: status %d", name, resp.StatusCode)
+		}
+	}
+	if len(s.fileCache.entries) != 2 {
+		t.Fatalf("%d files cached, want 2", len(s.fileCache.entries))
+	}
+	
+	resp := roundTrip(t, s, "DELETE /files/dir?recursive=1 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if resp.StatusCode != 200 {
+		t.Fatalf("DELETE: status %d", resp.StatusCode)
+	}
+	if len(s.fileCache.entries) != 0 || s.fileCache.size != 0 {
+		t.Errorf("%d files (%d bytes) still cached after deleting their directory", len(s.fileCache.entries), s.fileCache.size)
+	}
+}
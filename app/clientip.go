@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Parse trusted proxies parses proxy addresses and CIDR ranges such as 10.0.0.0/8.
+// A bare address stands for itself alone.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %v", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", entry, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// Is trusted proxy reports whether ip belongs to one of the trusted proxy ranges, or
+// is a loopback or private address when TrustProxy is set
+func (s *Server) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if s.config.TrustProxy && (addr.IsLoopback() || addr.IsPrivate()) {
+		return true
+	}
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client IP returns the address of the client a request comes from. Behind a trusted
+// proxy that is taken from X-Forwarded-For, walking it from the right past any other
+// trusted proxies to the first address that isn't one; entries further left are
+// whatever the client chose to send. A proxy that sends X-Real-IP instead is taken
+// at its word. Requests from other peers keep the socket address.
+func (s *Server) clientIP(headers map[string]string, remoteAddr net.Addr) string {
+	peer, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		peer = remoteAddr.String()
+	}
+	if !s.isTrustedProxy(peer) {
+		return peer
+	}
+	
+	forwardedFor, ok := headers["X-Forwarded-For"]
+	if !ok {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(headers["X-Real-Ip"])); err == nil {
+			return realIP.String()
+		}
+		return peer
+	}
+	hops := strings.Split(forwardedFor, ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// A malformed entry can't be followed any further
+			break
+		}
+		client = hop
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return client
+}
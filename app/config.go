@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written in config files as a string like "30s"
+type Duration time.Duration
+
+// Unmarshal JSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Config represents server configuration
+type Config struct {
+	Port      string `json:"port"`
+	Directory string `json:"directory"`
+	// IndexFile, when set, is a file in Directory such as index.html that / serves
+	// instead of the welcome message whenever it exists
+	IndexFile string `json:"index_file"`
+	// BindAddress is the interface IP to listen on (0.0.0.0 for all interfaces);
+	// IPv6 addresses such as ::1 are written without brackets
+	BindAddress string `json:"bind_address"`
+	// APITokens, when non-empty, are the bearer tokens accepted on /api/* routes
+	APITokens []string `json:"api_tokens"`
+	// RateLimit is the sustained requests per second allowed per client IP (0 disables limiting)
+	RateLimit float64 `json:"rate_limit"`
+	// RateBurst is the number of requests a client may make in a burst
+	RateBurst int `json:"rate_burst"`
+	// TrustProxy trusts loopback and private network peers as proxies, as when the
+	// server sits behind nginx on the same host or network, on top of TrustedProxies
+	TrustProxy bool `json:"trust_proxy"`
+	// TrustedProxies are the addresses or CIDR ranges of proxies whose X-Forwarded-For
+	// header is believed when working out the client's IP for logs and rate limiting
+	TrustedProxies []string `json:"trusted_proxies"`
+	// CORS controls cross-origin access to /api/* routes
+	CORS CORSConfig `json:"cors"`
+	// MaxConnections bounds the number of connections handled at once; excess
+	// connections get a 503 and are closed (0 means unlimited)
+	MaxConnections int `json:"max_connections"`
+	// Workers, when positive, serves connections from a fixed pool of that many
+	// goroutines instead of one goroutine per connection
+	Workers int `json:"workers"`
+	// MaxRequestsPerConn closes a keep-alive connection after this many requests,
+	// marking the last response Connection: close (0 means unlimited)
+	MaxRequestsPerConn int `json:"max_requests_per_conn"`
+	// MaxRequestLine caps the length in bytes of a request line; longer ones get a
+	// 414 and the connection is closed (0 means unlimited)
+	MaxRequestLine int `json:"max_request_line"`
+	// MaxUploadSize caps the size in bytes of files written through /files (0 means unlimited)
+	MaxUploadSize int64 `json:"max_upload_size"`
+	// CacheBytes is the memory budget for caching file contents served from /files (0 disables the cache)
+	CacheBytes int64 `json:"cache_bytes"`
+	// ServeDotfiles allows access to files and directories whose names start with "."
+	ServeDotfiles bool `json:"serve_dotfiles"`
+	// EnableDirectoryListing lists directories under /files that have no index page;
+	// when false such requests get a 403
+	EnableDirectoryListing bool `json:"enable_directory_listing"`
+	// LogFormat selects the access log format: "text" (the default) or "json"
+	LogFormat string `json:"log_format"`
+	// EnablePprof serves net/http/pprof on a separate debug listener at PprofAddress
+	EnablePprof  bool   `json:"enable_pprof"`
+	PprofAddress string `json:"pprof_address"`
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// SecurityHeaders are added to every routed response. Entries from a config file
+	// are merged over the defaults; an empty value removes that header.
+	SecurityHeaders map[string]string `json:"security_headers"`
+	// HTMLSecurityHeaders are only added to text/html responses, for headers such as
+	// X-Frame-Options that mean nothing to JSON or file downloads. They are merged
+	// over the defaults in the same way.
+	HTMLSecurityHeaders map[string]string `json:"html_security_headers"`
+	// RequestTimeout bounds how long a handler may run before the client gets a 503 (0 means no limit)
+	RequestTimeout Duration `json:"request_timeout"`
+	// IdleTimeout is how long a keep-alive connection may wait for its next request
+	// before it is closed (0 means no limit); responses announce it in Keep-Alive
+	IdleTimeout Duration `json:"idle_timeout"`
+	// MaxDelay caps how long /api/delay/:seconds may sleep
+	MaxDelay Duration `json:"max_delay"`
+	// SSEHeartbeat is how often event streams send a heartbeat comment (0 disables heartbeats)
+	SSEHeartbeat Duration `json:"sse_heartbeat"`
+	// StrictJSON rejects JSON request bodies with fields the endpoint doesn't know
+	StrictJSON bool `json:"strict_json"`
+	// StaticCacheControl is the Cache-Control value sent with files, e.g.
+	// "public, max-age=3600" (empty sends none)
+	StaticCacheControl string `json:"static_cache_control"`
+	// ImmutableAssets marks fingerprinted files such as app.3f9a2b7c.js as cacheable
+	// for a year without revalidation, since their names change with their content
+	ImmutableAssets bool `json:"immutable_assets"`
+	// EmbeddedAssets serves the assets compiled into the binary under /static
+	EmbeddedAssets bool `json:"embedded_assets"`
+	// ProxyRoutes forwards requests under each path prefix to an upstream server, e.g.
+	// "/backend": "http://localhost:9000/api" serves /backend/users from /api/users
+	ProxyRoutes map[string]string `json:"proxy_routes"`
+	// VirtualHosts serves every request whose Host header names one of the hosts from
+	// that host's upstream server, e.g. "docs.example.com": "http://localhost:9001"
+	VirtualHosts map[string]string `json:"virtual_hosts"`
+	// ShutdownTimeout is how long shutdown waits for in-flight requests before
+	// closing their connections
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// DefaultConfig returns the configuration used when no file or flags override it
+func DefaultConfig() Config {
+	return Config{
+		Port:        "8080",
+		Directory:   ".",
+		BindAddress: "0.0.0.0",
+		LogFormat:   "text",
+		CORS:        DefaultCORSConfig(),
+		// Listing stays on by default for compatibility with existing deployments
+		EnableDirectoryListing: true,
+		StrictJSON:             true,
+		SecurityHeaders: map[string]string{
+			"X-Content-Type-Options": "nosniff",
+		},
+		HTMLSecurityHeaders: map[string]string{
+			"X-Frame-Options": "DENY",
+		},
+		// Profiling data is sensitive, so only expose it locally by default
+		PprofAddress:    "127.0.0.1:6060",
+		ShutdownTimeout: Duration(30 * time.Second),
+		IdleTimeout:     Duration(60 * time.Second),
+		MaxRequestLine:  8192,
+		MaxDelay:        Duration(10 * time.Second),
+		SSEHeartbeat:    Duration(15 * time.Second),
+	}
+}
+
+// Merge headers returns a copy of defaults with overrides merged over it, matching
+// header names case-insensitively
+func mergeHeaders(defaults map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(overrides))
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range overrides {
+		merged[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	return merged
+}
+
+// LoadConfig reads a JSON config file over base. Fields missing from the file keep
+// their values from base, and unknown fields are rejected so a misspelled key
+// isn't silently ignored.
+func LoadConfig(base Config, path string) (Config, error) {
+	config := base
+	
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config file: %v", err)
+	}
+	config.SecurityHeaders = nil
+	config.HTMLSecurityHeaders = nil
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	
+	config.SecurityHeaders = mergeHeaders(base.SecurityHeaders, config.SecurityHeaders)
+	config.HTMLSecurityHeaders = mergeHeaders(base.HTMLSecurityHeaders, config.HTMLSecurityHeaders)
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// LoadEnv overrides config with the HTTP_* environment variables that are set.
+// Each is named after its config file key, e.g. HTTP_PORT or HTTP_MAX_UPLOAD_SIZE;
+// lists such as HTTP_API_TOKENS are comma-separated.
+func LoadEnv(config Config) (Config, error) {
+	env := &envReader{}
+	env.setString("HTTP_PORT", &config.Port)
+	env.setString("HTTP_DIRECTORY", &config.Directory)
+	env.setString("HTTP_INDEX_FILE", &config.IndexFile)
+	env.setString("HTTP_BIND_ADDRESS", &config.BindAddress)
+	env.setString("HTTP_LOG_FORMAT", &config.LogFormat)
+	env.setList("HTTP_API_TOKENS", &config.APITokens)
+	env.setFloat("HTTP_RATE_LIMIT", &config.RateLimit)
+	env.setInt("HTTP_RATE_BURST", &config.RateBurst)
+	env.setBool("HTTP_TRUST_PROXY", &config.TrustProxy)
+	env.setList("HTTP_TRUSTED_PROXIES", &config.TrustedProxies)
+	env.setList("HTTP_CORS_ALLOWED_ORIGINS", &config.CORS.AllowedOrigins)
+	env.setBool("HTTP_CORS_ALLOW_CREDENTIALS", &config.CORS.AllowCredentials)
+	env.setInt("HTTP_MAX_CONNECTIONS", &config.MaxConnections)
+	env.setInt("HTTP_WORKERS", &config.Workers)
+	env.setInt("HTTP_MAX_REQUESTS_PER_CONN", &config.MaxRequestsPerConn)
+	env.setInt("HTTP_MAX_REQUEST_LINE", &config.MaxRequestLine)
+	env.setInt64("HTTP_MAX_UPLOAD_SIZE", &config.MaxUploadSize)
+	env.setInt64("HTTP_CACHE_BYTES", &config.CacheBytes)
+	env.setBool("HTTP_SERVE_DOTFILES", &config.ServeDotfiles)
+	env.setBool("HTTP_ENABLE_DIRECTORY_LISTING", &config.EnableDirectoryListing)
+	env.setBool("HTTP_STRICT_JSON", &config.StrictJSON)
+	env.setBool("HTTP_ENABLE_PPROF", &config.EnablePprof)
+	env.setString("HTTP_PPROF_ADDRESS", &config.PprofAddress)
+	env.setString("HTTP_TLS_CERT_FILE", &config.TLSCertFile)
+	env.setString("HTTP_TLS_KEY_FILE", &config.TLSKeyFile)
+	env.setDuration("HTTP_REQUEST_TIMEOUT", &config.RequestTimeout)
+	env.setDuration("HTTP_SHUTDOWN_TIMEOUT", &config.ShutdownTimeout)
+	env.setString("HTTP_STATIC_CACHE_CONTROL", &config.StaticCacheControl)
+	env.setBool("HTTP_IMMUTABLE_ASSETS", &config.ImmutableAssets)
+	env.setBool("HTTP_EMBEDDED_ASSETS", &config.EmbeddedAssets)
+	env.setDuration("HTTP_IDLE_TIMEOUT", &config.IdleTimeout)
+	env.setDuration("HTTP_MAX_DELAY", &config.MaxDelay)
+	env.setDuration("HTTP_SSE_HEARTBEAT", &config.SSEHeartbeat)
+	env.setMap("HTTP_PROXY_ROUTES", &config.ProxyRoutes)
+	env.setMap("HTTP_VIRTUAL_HOSTS", &config.VirtualHosts)
+	return config, env.err
+}
+
+// Parse flags applies command line arguments over config. A --config file is loaded
+// first wherever it appears, so the other flags override its values.
+func parseFlags(config Config, args []string) (Config, error) {
+	// Load the config file first so command line flags override its values
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == "--config" {
+			loaded, err := LoadConfig(config, args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Config error: %v", err)
+			}
+			config = loaded
+		}
+	}
+	
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--config" && i+1 < len(args) {
+			// Already loaded above
+			i++
+		} else if args[i] == "--directory" && i+1 < len(args) {
+			config.Directory = args[i+1]
+			i++
+		} else if args[i] == "--index-file" && i+1 < len(args) {
+			config.IndexFile = args[i+1]
+			i++
+		} else if args[i] == "--port" && i+1 < len(args) {
+			config.Port = args[i+1]
+			i++
+		} else if (args[i] == "--bind" || args[i] == "--host") && i+1 < len(args) {
+			// Accept IPv6 addresses with or without URL-style brackets
+			config.BindAddress = strings.TrimSuffix(strings.TrimPrefix(args[i+1], "["), "]")
+			i++
+		} else if args[i] == "--log-format" && i+1 < len(args) {
+			config.LogFormat = args[i+1]
+			i++
+		} else if args[i] == "--max-connections" && i+1 < len(args) {
+			limit, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --max-connections: %v", err)
+			}
+			config.MaxConnections = limit
+			i++
+		} else if args[i] == "--workers" && i+1 < len(args) {
+			workers, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --workers: %v", err)
+			}
+			config.Workers = workers
+			i++
+		} else if args[i] == "--max-requests-per-conn" && i+1 < len(args) {
+			limit, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --max-requests-per-conn: %v", err)
+			}
+			config.MaxRequestsPerConn = limit
+			i++
+		} else if args[i] == "--max-request-line" && i+1 < len(args) {
+			limit, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --max-request-line: %v", err)
+			}
+			config.MaxRequestLine = limit
+			i++
+		} else if args[i] == "--max-upload-size" && i+1 < len(args) {
+			size, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return config, fmt.Errorf("Invalid --max-upload-size: %v", err)
+			}
+			config.MaxUploadSize = size
+			i++
+		} else if args[i] == "--cache-bytes" && i+1 < len(args) {
+			size, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return config, fmt.Errorf("Invalid --cache-bytes: %v", err)
+			}
+			config.CacheBytes = size
+			i++
+		} else if args[i] == "--request-timeout" && i+1 < len(args) {
+			timeout, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --request-timeout: %v", err)
+			}
+			config.RequestTimeout = Duration(timeout)
+			i++
+		} else if args[i] == "--shutdown-timeout" && i+1 < len(args) {
+			timeout, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --shutdown-timeout: %v", err)
+			}
+			config.ShutdownTimeout = Duration(timeout)
+			i++
+		} else if args[i] == "--static-cache-control" && i+1 < len(args) {
+			config.StaticCacheControl = args[i+1]
+			i++
+		} else if args[i] == "--immutable-assets" {
+			config.ImmutableAssets = true
+		} else if args[i] == "--embedded-assets" {
+			config.EmbeddedAssets = true
+		} else if args[i] == "--idle-timeout" && i+1 < len(args) {
+			timeout, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --idle-timeout: %v", err)
+			}
+			config.IdleTimeout = Duration(timeout)
+			i++
+		} else if args[i] == "--max-delay" && i+1 < len(args) {
+			delay, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --max-delay: %v", err)
+			}
+			config.MaxDelay = Duration(delay)
+			i++
+		} else if args[i] == "--proxy" && i+1 < len(args) {
+			prefix, upstream, _ := strings.Cut(args[i+1], "=")
+			if config.ProxyRoutes == nil {
+				config.ProxyRoutes = make(map[string]string)
+			}
+			config.ProxyRoutes[prefix] = upstream
+			i++
+		} else if args[i] == "--vhost" && i+1 < len(args) {
+			host, upstream, _ := strings.Cut(args[i+1], "=")
+			if config.VirtualHosts == nil {
+				config.VirtualHosts = make(map[string]string)
+			}
+			config.VirtualHosts[host] = upstream
+			i++
+		} else if args[i] == "--sse-heartbeat" && i+1 < len(args) {
+			interval, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --sse-heartbeat: %v", err)
+			}
+			config.SSEHeartbeat = Duration(interval)
+			i++
+		} else if args[i] == "--tls-cert" && i+1 < len(args) {
+			config.TLSCertFile = args[i+1]
+			i++
+		} else if args[i] == "--tls-key" && i+1 < len(args) {
+			config.TLSKeyFile = args[i+1]
+			i++
+		} else if args[i] == "--no-directory-listing" {
+			config.EnableDirectoryListing = false
+		} else if args[i] == "--lenient-json" {
+			config.StrictJSON = false
+		} else if args[i] == "--serve-dotfiles" {
+			config.ServeDotfiles = true
+		} else if args[i] == "--pprof" {
+			config.EnablePprof = true
+		} else if args[i] == "--pprof-addr" && i+1 < len(args) {
+			config.PprofAddress = args[i+1]
+			i++
+		} else if args[i] == "--api-token" && i+1 < len(args) {
+			config.APITokens = append(config.APITokens, args[i+1])
+			i++
+		} else if args[i] == "--rate-limit" && i+1 < len(args) {
+			rate, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil {
+				return config, fmt.Errorf("Invalid --rate-limit: %v", err)
+			}
+			config.RateLimit = rate
+			i++
+		} else if args[i] == "--rate-burst" && i+1 < len(args) {
+			burst, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return config, fmt.Errorf("Invalid --rate-burst: %v", err)
+			}
+			config.RateBurst = burst
+			i++
+		} else if args[i] == "--security-header" && i+1 < len(args) {
+			name, value, _ := strings.Cut(args[i+1], ":")
+			config.SecurityHeaders[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+			i++
+		} else if args[i] == "--html-security-header" && i+1 < len(args) {
+			name, value, _ := strings.Cut(args[i+1], ":")
+			config.HTMLSecurityHeaders[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+			i++
+		} else if args[i] == "--trust-proxy" {
+			config.TrustProxy = true
+		} else if args[i] == "--trusted-proxy" && i+1 < len(args) {
+			config.TrustedProxies = append(config.TrustedProxies, args[i+1])
+			i++
+		} else if args[i] == "--cors-origin" && i+1 < len(args) {
+			config.CORS.AllowedOrigins = append(config.CORS.AllowedOrigins, args[i+1])
+			i++
+		} else if args[i] == "--cors-credentials" {
+			config.CORS.AllowCredentials = true
+		}
+	}
+	return config, nil
+}
+
+// envReader parses environment variables into config fields, keeping the first error
+type envReader struct {
+	err error
+}
+
+// Lookup returns a variable's value, skipping the rest once one has failed to parse
+func (e *envReader) lookup(name string) (string, bool) {
+	if e.err != nil {
+		return "", false
+	}
+	return os.LookupEnv(name)
+}
+
+// Fail records why a variable couldn't be parsed
+func (e *envReader) fail(name string, value string, err error) {
+	e.err = fmt.Errorf("invalid %s %q: %v", name, value, err)
+}
+
+// Set string copies a variable as is
+func (e *envReader) setString(name string, dst *string) {
+	if value, ok := e.lookup(name); ok {
+		*dst = value
+	}
+}
+
+// Set list splits a comma-separated variable, dropping empty items
+func (e *envReader) setList(name string, dst *[]string) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	*dst = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dst = append(*dst, item)
+		}
+	}
+}
+
+// Set map splits a comma-separated variable of key=value pairs
+func (e *envReader) setMap(name string, dst *map[string]string) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+	*dst = make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		key, itemValue, found := strings.Cut(item, "=")
+		if !found {
+			e.fail(name, value, fmt.Errorf("%q is not a key=value pair", item))
+			return
+		}
+		(*dst)[strings.TrimSpace(key)] = strings.TrimSpace(itemValue)
+	}
+}
+
+// Set int, set int64, set float, set bool and set duration parse a variable into dst
+func (e *envReader) setInt(name string, dst *int) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			e.fail(name, value, err)
+			return
+		}
+		*dst = parsed
+	}
+}
+
+func (e *envReader) setInt64(name string, dst *int64) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			e.fail(name, value, err)
+			return
+		}
+		*dst = parsed
+	}
+}
+
+func (e *envReader) setFloat(name string, dst *float64) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.fail(name, value, err)
+			return
+		}
+		*dst = parsed
+	}
+}
+
+func (e *envReader) setBool(name string, dst *bool) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			e.fail(name, value, err)
+			return
+		}
+		*dst = parsed
+	}
+}
+
+func (e *envReader) setDuration(name string, dst *Duration) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			e.fail(name, value, err)
+			return
+		}
+		*dst = Duration(parsed)
+	}
+}
+
+// TLS enabled reports whether the server is configured to serve HTTPS
+func (c Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// Validate checks that required fields are present and well-formed
+func (c Config) Validate() error {
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("port %q must be a number between 0 and 65535", c.Port)
+	}
+	if c.Directory == "" {
+		return fmt.Errorf("directory is required")
+	}
+	if c.IndexFile != "" && !filepath.IsLocal(c.IndexFile) {
+		return fmt.Errorf("index file %q must be a path inside the directory", c.IndexFile)
+	}
+	if net.ParseIP(c.BindAddress) == nil {
+		return fmt.Errorf("bind address %q must be an IP address", c.BindAddress)
+	}
+	if c.LogFormat != "" && c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log format %q must be \"text\" or \"json\"", c.LogFormat)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if err := c.CORS.Validate(); err != nil {
+		return err
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request timeout must not be negative")
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("workers must not be negative")
+	}
+	if c.MaxConnections < 0 {
+		return fmt.Errorf("max connections must not be negative")
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+	if c.RateBurst < 0 {
+		return fmt.Errorf("rate burst must not be negative")
+	}
+	if c.MaxUploadSize < 0 {
+		return fmt.Errorf("max upload size must not be negative")
+	}
+	if c.MaxRequestsPerConn < 0 {
+		return fmt.Errorf("max requests per connection must not be negative")
+	}
+	if c.MaxRequestLine < 0 {
+		return fmt.Errorf("max request line must not be negative")
+	}
+	if c.CacheBytes < 0 {
+		return fmt.Errorf("cache bytes must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout must not be negative")
+	}
+	if c.MaxDelay < 0 {
+		return fmt.Errorf("max delay must not be negative")
+	}
+	if c.SSEHeartbeat < 0 {
+		return fmt.Errorf("SSE heartbeat must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must not be negative")
+	}
+	for prefix, upstream := range c.ProxyRoutes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("proxy prefix %q must start with /", prefix)
+		}
+		if _, err := parseUpstream(upstream); err != nil {
+			return fmt.Errorf("proxy route %s: %v", prefix, err)
+		}
+	}
+	for host, upstream := range c.VirtualHosts {
+		if hostName(host) == "" {
+			return fmt.Errorf("virtual host name must not be empty")
+		}
+		if _, err := parseUpstream(upstream); err != nil {
+			return fmt.Errorf("virtual host %s: %v", host, err)
+		}
+	}
+	return nil
+}
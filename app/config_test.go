@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write config writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `{
+		"port": "9000",
+		"max_upload_size": 1024,
+		"request_timeout": "5s",
+		"security_headers": {"referrer-policy": "no-referrer"}
+	}`)
+	config, err := LoadConfig(DefaultConfig(), path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	
+	if config.Port != "9000" || config.MaxUploadSize != 1024 || config.RequestTimeout != Duration(5*time.Second) {
+		t.Errorf("file values not applied: port %q, max upload %d, request timeout %v",
+			config.Port, config.MaxUploadSize, time.Duration(config.RequestTimeout))
+	}
+	// Fields left out keep their defaults
+	if config.Directory != "." || config.IdleTimeout != Duration(60*time.Second) || !config.StrictJSON {
+		t.Errorf("defaults lost: directory %q, idle timeout %v, strict JSON %v",
+			config.Directory, time.Duration(config.IdleTimeout), config.StrictJSON)
+	}
+	// Header maps merge over the defaults instead of replacing them
+	if config.SecurityHeaders["Referrer-Policy"] != "no-referrer" || config.SecurityHeaders["X-Content-Type-Options"] != "nosniff" {
+		t.Errorf("security headers = %v, want the default merged with Referrer-Policy", config.SecurityHeaders)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), "failed to read config file"},
+		{"malformed", writeConfig(t, `{"port": `), "failed to parse config file"},
+		{"unknown field", writeConfig(t, `{"prot": "9000"}`), `unknown field "prot"`},
+		{"unknown nested field", writeConfig(t, `{"cors": {"allowed_origin": ["*"]}}`), `unknown field "allowed_origin"`},
+		{"wrong type", writeConfig(t, `{"workers": "four"}`), "failed to parse config file"},
+		{"invalid value", writeConfig(t, `{"workers": -1}`), "invalid config file"},
+		{"negative max connections", writeConfig(t, `{"max_connections": -1}`), "max connections must not be negative"},
+		{"negative rate limit", writeConfig(t, `{"rate_limit": -0.5}`), "rate limit must not be negative"},
+		{"negative rate burst", writeConfig(t, `{"rate_burst": -1}`), "rate burst must not be negative"},
+		{"negative max upload size", writeConfig(t, `{"max_upload_size": -1}`), "max upload size must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadConfig(DefaultConfig(), tt.path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	t.Setenv("HTTP_PORT", "1111")
+	t.Setenv("HTTP_DIRECTORY", "/from-env")
+	t.Setenv("HTTP_LOG_FORMAT", "json")
+	path := writeConfig(t, `{"port": "2222", "directory": "/from-file", "workers": 4}`)
+	
+	config, err := LoadEnv(DefaultConfig())
+	if err != nil {
+		t.Fatalf("LoadEnv: %v", err)
+	}
+	// --config comes last to show it is loaded before the other flags wherever it appears
+	config, err = parseFlags(config, []string{"--port", "3333", "--config", path})
+	if err != nil {
+		t.Fatalf("parseFlags: %v", err)
+	}
+	
+	if config.Port != "3333" {
+		t.Errorf("port = %q, want the flag's 3333", config.Port)
+	}
+	if config.Directory != "/from-file" {
+		t.Errorf("directory = %q, want the file's /from-file", config.Directory)
+	}
+	if config.LogFormat != "json" {
+		t.Errorf("log format = %q, want the environment's json", config.LogFormat)
+	}
+	if config.Workers != 4 {
+		t.Errorf("workers = %d, want the file's 4", config.Workers)
+	}
+	if config.BindAddress != "0.0.0.0" {
+		t.Errorf("bind address = %q, want the default 0.0.0.0", config.BindAddress)
+	}
+}
+
+func TestParseFlagsErrors(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"--workers", "many"}, "Invalid --workers"},
+		{[]string{"--max-upload-size", "10MB"}, "Invalid --max-upload-size"},
+		{[]string{"--request-timeout", "soon"}, "Invalid --request-timeout"},
+		{[]string{"--config", filepath.Join(t.TempDir(), "missing.json")}, "Config error"},
+	}
+	for _, tt := range tests {
+		_, err := parseFlags(DefaultConfig(), tt.args)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+			t.Errorf("%v: error = %v, want one starting %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
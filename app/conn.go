@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+)
+
+// flusher is implemented by connections that buffer their writes
+type flusher interface {
+	Flush() error
+}
+
+// bufferedConn coalesces writes to a connection so a response's headers and
+// body go out together once flushed
+type bufferedConn struct {
+	net.Conn
+	writer *bufio.Writer
+}
+
+// New buffered conn wraps a connection with a write buffer
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, writer: bufio.NewWriterSize(conn, 32*1024)}
+}
+
+// Write buffers b until the next Flush
+func (c *bufferedConn) Write(b []byte) (int, error) {
+	return c.writer.Write(b)
+}
+
+// Flush writes any buffered data to the connection
+func (c *bufferedConn) Flush() error {
+	return c.writer.Flush()
+}
+
+// Close flushes buffered data before closing the connection
+func (c *bufferedConn) Close() error {
+	flushErr := c.writer.Flush()
+	if err := c.Conn.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// Flush conn flushes a connection if it buffers writes
+func flushConn(conn net.Conn) error {
+	if f, ok := conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// hijacker is implemented by connections a handler can take over from the server,
+// e.g. to speak another protocol after an upgrade
+type hijacker interface {
+	hijack() (*bufio.Reader, error)
+}
+
+// Hijack conn takes a connection over from the server, returning the reader that
+// holds whatever the client has sent past the current request. The server reads
+// no more requests from the connection and closes it once the handler returns.
+func hijackConn(conn net.Conn) (*bufio.Reader, error) {
+	if h, ok := conn.(hijacker); ok {
+		return h.hijack()
+	}
+	return nil, errors.New("connection can't be taken over")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countConn counts the writes made to the connection it wraps
+type countConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestOneWritePerResponse(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	filesDir := filepath.Join(s.config.Directory, "files")
+	if err := os.MkdirAll(filesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(filesDir, "page.txt"), []byte(strings.Repeat("hello ", 500)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &countConn{Conn: server}
+	go s.handleConnection(conn)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(client)
+	
+	requests := []struct {
+		raw    string
+		status int
+	}{
+		{"GET /echo/abc HTTP/1.1\r\nHost: localhost\r\n\r\n", 200},
+		{"GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n", 200},
+		{"GET /files/page.txt HTTP/1.1\r\nHost: localhost\r\n\r\n", 200},
+		{"GET /files/missing.txt HTTP/1.1\r\nHost: localhost\r\n\r\n", 404},
+	}
+	for i, request := range requests {
+		if _, err := io.WriteString(client, request.raw); err != nil {
+			t.Fatalf("writing request %d: %v", i, err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("reading response %d: %v", i, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != request.status {
+			t.Fatalf("response %d has status %d, want %d", i, resp.StatusCode, request.status)
+		}
+		if got := conn.writes.Load(); got != int32(i+1) {
+			t.Fatalf("after response %d the connection had %d writes, want %d", i, got, i+1)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestContextCancelledOnDisconnect(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	entered := make(chan struct{})
+	cancelled := make(chan error, 1)
+	s.router.Handle("GET", "/wait", func(conn net.Conn, req *Request) {
+		close(entered)
+		select {
+		case <-req.Context().Done():
+			cancelled <- req.Context().Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+	})
+	
+	client, server := net.Pipe()
+	go s.handleConnection(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, "GET /wait HTTP/1.1\r\nHost: localhost\r\n\r\n"); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	<-entered
+	client.Close()
+	
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("context error after disconnect = %v, want context.Canceled", err)
+	}
+}
+
+func TestContextLiveWhileConnected(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	s.router.Handle("GET", "/check", func(conn net.Conn, req *Request) {
+		// Give a disconnect watcher time to misfire
+		time.Sleep(20 * time.Millisecond)
+		status := "live"
+		if req.Context().Err() != nil {
+			status = "cancelled"
+		}
+		sendResponse(conn, 200, "OK", "text/plain", []byte(status), req.ResponseHeaders, false, req.Close)
+	})
+	
+	resp := roundTrip(t, s, "GET /check HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if body := responseBody(t, resp); body != "live" {
+		t.Errorf("context was %s while the client was connected", body)
+	}
+}
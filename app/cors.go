@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig controls which cross-origin requests are allowed on API routes
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long, in seconds, browsers may cache preflight results
+	MaxAge int `json:"max_age"`
+}
+
+// DefaultCORSConfig returns a CORS configuration with no allowed origins
+// and permissive defaults for everything else
+func DefaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", "Authorization"},
+		MaxAge:         600,
+	}
+}
+
+// Validate rejects settings that would let any site make credentialed requests
+func (c CORSConfig) Validate() error {
+	if !c.AllowCredentials {
+		return nil
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			return fmt.Errorf("CORS can't allow credentials with a wildcard origin")
+		}
+	}
+	return nil
+}
+
+// Origin allowed reports whether the origin is in the allowlist
+func (c CORSConfig) originAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply CORS adds the Access-Control-* headers for an allowed origin and
+// reports whether the request is a preflight that should be answered directly
+func (c CORSConfig) applyCORS(method string, headers map[string]string, responseHeaders Header) bool {
+	origin := headers["Origin"]
+	preflight := method == "OPTIONS" && headers["Access-Control-Request-Method"] != ""
+	if len(c.AllowedOrigins) > 0 {
+		// Responses differ per origin, so caches must key on it
+		responseHeaders.Set("Vary", "Origin")
+	}
+	if origin == "" || !c.originAllowed(origin) {
+		return preflight
+	}
+	
+	responseHeaders.Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		responseHeaders.Set("Access-Control-Allow-Credentials", "true")
+	}
+	
+	if preflight {
+		responseHeaders.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		responseHeaders.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		if c.MaxAge > 0 {
+			responseHeaders.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+	}
+	return preflight
+}
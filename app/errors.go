@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// ErrorResponse is the JSON body of an error response
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// Write error sends an error response with the standard status text. The body is
+// JSON when accept, the request's Accept header, prefers it to plain text, and the
+// bare message otherwise. A Connection: close in headers closes the connection after
+// the response. Error bodies are short, so they are never compressed.
+func writeError(conn net.Conn, statusCode int, message string, headers Header, accept string) {
+	closeConnection := hasToken(headers.Get("Connection"), "close")
+	if negotiateContentType(accept, "text/plain", "application/json") == "application/json" {
+		body, _ := json.Marshal(ErrorResponse{Error: message, Status: statusCode})
+		sendResponse(conn, statusCode, http.StatusText(statusCode), "application/json", body, headers, false, closeConnection)
+		return
+	}
+	sendResponse(conn, statusCode, http.StatusText(statusCode), "text/plain", []byte(message), headers, false, closeConnection)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteErrorNegotiatesBody(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"", "text/plain", "No such thing"},
+		{"*/*", "text/plain", "No such thing"},
+		{"text/html;q=0.5, application/json", "application/json", `{"error":"No such thing","status":404}`},
+		{"application/json", "application/json", `{"error":"No such thing","status":404}`},
+	}
+	for _, tt := range tests {
+		conn := &recordConn{}
+		writeError(conn, 404, "No such thing", Header{"X-Request-ID": {"abc"}}, tt.accept)
+		resp := conn.response(t)
+		if resp.StatusCode != 404 || resp.Status != "404 Not Found" {
+			t.Errorf("Accept %q: status = %q", tt.accept, resp.Status)
+		}
+		if got := resp.Header.Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, got, tt.contentType)
+		}
+		if got := responseBody(t, resp); got != tt.body {
+			t.Errorf("Accept %q: body = %q, want %q", tt.accept, got, tt.body)
+		}
+		if got := resp.Header.Get("X-Request-Id"); got != "abc" {
+			t.Errorf("Accept %q: X-Request-ID = %q, want the one passed in", tt.accept, got)
+		}
+	}
+}
+
+func TestWriteErrorJSONShape(t *testing.T) {
+	conn := &recordConn{}
+	writeError(conn, 500, `quote " and newline`+"\n", nil, "application/json")
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(responseBody(t, conn.response(t))), &got); err != nil {
+		t.Fatalf("body isn't JSON: %v", err)
+	}
+	want := map[string]interface{}{"error": `quote " and newline` + "\n", "status": float64(500)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+}
+
+func TestWriteErrorConnectionClose(t *testing.T) {
+	conn := &recordConn{}
+	writeError(conn, 400, "Bad Request", Header{"Connection": {"close"}}, "")
+	if !conn.response(t).Close {
+		t.Error("Connection: close in the headers didn't close the connection")
+	}
+	if n := strings.Count(conn.buf.String(), "Connection:"); n != 1 {
+		t.Errorf("%d Connection headers, want 1:\n%s", n, conn.buf.String())
+	}
+	
+	conn = &recordConn{}
+	writeError(conn, 400, "Bad Request", nil, "")
+	if conn.response(t).Close {
+		t.Error("connection closed without Connection: close in the headers")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/url"
+)
+
+// formKey is the context key for a request's parsed form body
+type formKey struct{}
+
+// parsedForm is what parsing a request's form body produced, kept in the request's
+// context so handlers that don't read forms never see a malformed one
+type parsedForm struct {
+	form map[string][]string
+	err  error
+}
+
+// Parse form decodes an application/x-www-form-urlencoded body into its fields,
+// keeping every value of a repeated field in order. Bodies of any other type have
+// no form, so nil is returned without an error.
+func parseForm(contentType string, body []byte) (map[string][]string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "application/x-www-form-urlencoded" {
+		return nil, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid form body: %v", err)
+	}
+	return form, nil
+}
+
+// Form from context returns the parsed form body of the request a context belongs
+// to, nil if the request had none, or the error parsing it ran into
+func formFromContext(ctx context.Context) (map[string][]string, error) {
+	parsed, _ := ctx.Value(formKey{}).(parsedForm)
+	return parsed.form, parsed.err
+}
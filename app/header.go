@@ -0,0 +1,39 @@
+package main
+
+// Header holds the header fields of a response. A field can have several values,
+// and each goes out on a line of its own, which is how Set-Cookie has to be
+// repeated. Names are kept exactly as given, so they are sent in the case the
+// server chose.
+type Header map[string][]string
+
+// Set replaces any values of key with value
+func (h Header) Set(key string, value string) {
+	h[key] = []string{value}
+}
+
+// Add adds a value for key without replacing any already set
+func (h Header) Add(key string, value string) {
+	h[key] = append(h[key], value)
+}
+
+// Get returns the first value of key, or "" if it has none
+func (h Header) Get(key string) string {
+	if values := h[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Del removes every value of key
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// Clone returns a copy of h, so either can be changed without affecting the other
+func (h Header) Clone() Header {
+	clone := make(Header, len(h))
+	for key, values := range h {
+		clone[key] = append([]string(nil), values...)
+	}
+	return clone
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHeaderAddAndSet(t *testing.T) {
+	h := make(Header)
+	h.Add("Set-Cookie", "a=1")
+	h.Add("Set-Cookie", "b=2")
+	if got := h["Set-Cookie"]; !reflect.DeepEqual(got, []string{"a=1", "b=2"}) {
+		t.Errorf("after Add, values = %q", got)
+	}
+	if got := h.Get("Set-Cookie"); got != "a=1" {
+		t.Errorf("Get = %q, want the first value", got)
+	}
+	
+	h.Set("Set-Cookie", "c=3")
+	if got := h["Set-Cookie"]; !reflect.DeepEqual(got, []string{"c=3"}) {
+		t.Errorf("after Set, values = %q", got)
+	}
+	
+	clone := h.Clone()
+	clone.Add("Set-Cookie", "d=4")
+	if len(h["Set-Cookie"]) != 1 {
+		t.Errorf("adding to a clone changed the original: %q", h["Set-Cookie"])
+	}
+	
+	h.Del("Set-Cookie")
+	if got := h.Get("Set-Cookie"); got != "" {
+		t.Errorf("after Del, Get = %q", got)
+	}
+}
+
+func TestWriteResponseHeadRepeatsValues(t *testing.T) {
+	var buf bytes.Buffer
+	headers := Header{"Set-Cookie": {"a=1", "b=2"}, "X-Request-ID": {"abc"}}
+	writeResponseHead(&buf, "HTTP/1.1", 200, "OK", "text/plain", headers, false)
+	
+	head := buf.String()
+	for _, line := range []string{"Set-Cookie: a=1\r\n", "Set-Cookie: b=2\r\n", "X-Request-ID: abc\r\n"} {
+		if strings.Count(head, line) != 1 {
+			t.Errorf("head doesn't have %q once:\n%s", line, head)
+		}
+	}
+}
+
+func TestProxyRelaysRepeatedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "x", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "y", Value: "2"})
+	}))
+	defer upstream.Close()
+	
+	config := DefaultConfig()
+	config.ProxyRoutes = map[string]string{"/backend": upstream.URL}
+	s := newTestServer(t, config)
+	
+	resp := roundTrip(t, s, "GET /backend/cookies HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if got := resp.Header.Values("Set-Cookie"); !reflect.DeepEqual(got, []string{"x=1", "y=2"}) {
+		t.Errorf("Set-Cookie lines = %q, want one per upstream cookie", got)
+	}
+}
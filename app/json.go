@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Write JSON marshals v and sends it as an application/json response. If v can't
+// be marshaled, a 500 is sent instead and the error is returned.
+func writeJSON(
+	conn net.Conn,
+	statusCode int,
+	v interface{},
+	headers Header,
+	supportsGzip bool,
+	closeConnection bool,
+) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(conn, 500, "Internal Server Error", headers, "application/json")
+		return fmt.Errorf("encoding JSON response: %v", err)
+	}
+	sendResponse(conn, statusCode, http.StatusText(statusCode), "application/json", body, headers, supportsGzip, closeConnection)
+	return nil
+}
+
+// Write negotiated sends fields as JSON, or as plain text "key: value" lines when
+// accept, the request's Accept header, prefers text/plain. JSON is the default, so clients that
+// accept anything or send no Accept header get JSON.
+func writeNegotiated(
+	conn net.Conn,
+	statusCode int,
+	fields map[string]string,
+	headers Header,
+	accept string,
+	supportsGzip bool,
+	closeConnection bool,
+) error {
+	// The body depends on Accept, so caches must key on it
+	headers.Add("Vary", "Accept")
+	if negotiateContentType(accept, "application/json", "text/plain") != "text/plain" {
+		return writeJSON(conn, statusCode, fields, headers, supportsGzip, closeConnection)
+	}
+	
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var body strings.Builder
+	for _, key := range keys {
+		body.WriteString(key + ": " + fields[key] + "\n")
+	}
+	sendResponse(conn, statusCode, http.StatusText(statusCode), "text/plain", []byte(body.String()), headers, supportsGzip, closeConnection)
+	return nil
+}
+
+// maxJSONBodySize caps the size of the JSON request bodies decodeJSON will parse
+const maxJSONBodySize = 1 << 20
+
+// errJSONTooLarge is returned by decodeJSON for bodies over maxJSONBodySize
+var errJSONTooLarge = errors.New("JSON body too large")
+
+// Decode JSON decodes a JSON request body into v. The body must hold a single JSON
+// value of at most maxJSONBodySize bytes; unless StrictJSON is turned off, objects
+// with fields v doesn't have are rejected too, so clients learn of their typos.
+func (s *Server) decodeJSON(body []byte, v interface{}) error {
+	if len(body) == 0 {
+		return errors.New("empty request body")
+	}
+	if len(body) > maxJSONBodySize {
+		return errJSONTooLarge
+	}
+	
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if s.config.StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	if decoder.More() {
+		return errors.New("invalid JSON: unexpected data after the value")
+	}
+	return nil
+}
+
+// JSON error status maps a decodeJSON error to the response status it calls for
+func jsonErrorStatus(err error) int {
+	if errors.Is(err, errJSONTooLarge) {
+		return 413
+	}
+	return 400
+}
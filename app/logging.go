@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// accessLogger writes JSON access log lines without the standard log prefix
+var accessLogger = log.New(os.Stderr, "", 0)
+
+// AccessLogEntry holds the fields recorded for each request
+type AccessLogEntry struct {
+	RequestID string
+	RemoteIP  string
+	Method    string
+	Path      string
+	Status    int
+	Bytes     int64
+	Duration  time.Duration
+}
+
+// responseTracker wraps a connection to record the status and number of bytes
+// written for a single response, along with the protocol version to answer in
+type responseTracker struct {
+	net.Conn
+	proto  string
+	status int
+	bytes  int64
+	// takeOver hands the connection's reader to a handler that hijacks it, and
+	// hijacked records that it did
+	takeOver func() *bufio.Reader
+	hijacked bool
+}
+
+// Write counts the bytes written through to the connection
+func (t *responseTracker) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+	t.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying connection if it buffers writes
+func (t *responseTracker) Flush() error {
+	return flushConn(t.Conn)
+}
+
+// Hijack hands the connection over to the handler
+func (t *responseTracker) hijack() (*bufio.Reader, error) {
+	if t.takeOver == nil {
+		return nil, errors.New("connection can't be taken over")
+	}
+	t.hijacked = true
+	return t.takeOver(), nil
+}
+
+// Set status records the response status
+func (t *responseTracker) setStatus(statusCode int) {
+	t.status = statusCode
+}
+
+// Protocol returns the protocol version to answer in
+func (t *responseTracker) protocol() string {
+	return t.proto
+}
+
+// Started reports whether any of the response has been written
+func (t *responseTracker) started() bool {
+	return t.bytes > 0
+}
+
+// statusRecorder is implemented by connections that track the response status
+type statusRecorder interface {
+	setStatus(statusCode int)
+}
+
+// protocolConn is implemented by connections that know the request's protocol version
+type protocolConn interface {
+	protocol() string
+}
+
+// Record status notes the response status on a tracked connection
+func recordStatus(conn net.Conn, statusCode int) {
+	if recorder, ok := conn.(statusRecorder); ok {
+		recorder.setStatus(statusCode)
+	}
+}
+
+// Response proto returns the protocol version for a response's status line
+func responseProto(conn net.Conn) string {
+	if pc, ok := conn.(protocolConn); ok && pc.protocol() != "" {
+		return pc.protocol()
+	}
+	return "HTTP/1.1"
+}
+
+// Log access writes an access log line in the configured format
+func (s *Server) logAccess(entry AccessLogEntry) {
+	if s.config.LogFormat == "json" {
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":        time.Now().UTC().Format(time.RFC3339Nano),
+			"request_id":  entry.RequestID,
+			"remote_ip":   entry.RemoteIP,
+			"method":      entry.Method,
+			"path":        entry.Path,
+			"status":      entry.Status,
+			"bytes":       entry.Bytes,
+			"duration_ms": float64(entry.Duration.Microseconds()) / 1000,
+		})
+		accessLogger.Println(string(line))
+		return
+	}
+	
+	log.Printf("request_id=%s remote_ip=%s method=%s path=%q status=%d bytes=%d duration=%s",
+		entry.RequestID, entry.RemoteIP, entry.Method, entry.Path, entry.Status, entry.Bytes, entry.Duration)
+}
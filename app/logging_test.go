@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Logged request sends one request over a fresh connection and returns the raw
+// response along with the access log line it produced
+func loggedRequest(t *testing.T, s *Server, logs *logBuffer, request string) (string, string) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, request); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	raw, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	
+	// The line is found by the response's request ID, since a connection another
+	// test left behind may still log. It is written once the response has gone out,
+	// so it may lag a little.
+	id := regexp.MustCompile(`(?i)\r\nX-Request-Id: (\w+)\r\n`).FindSubmatch(raw)
+	if id == nil {
+		t.Fatalf("no X-Request-ID in response %q", raw)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, string(id[1])) {
+				return string(raw), line
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no access log line in %q", logs.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+const loggedRequestLine = "POST /api/echo?x=1 HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: 11\r\nConnection: close\r\n\r\n{\"a\":\"b\"}\r\n"
+
+func TestAccessLogText(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestServer(t, Config{LogFormat: "text"})
+	raw, line := loggedRequest(t, s, logs, loggedRequestLine)
+	
+	fields := regexp.MustCompile(`method=(\S+) path="([^"]*)" status=(\d+) bytes=(\d+) duration=(\S+)`).FindStringSubmatch(line)
+	if fields == nil {
+		t.Fatalf("access log line %q is missing fields", line)
+	}
+	if fields[1] != "POST" {
+		t.Errorf("method = %s, want POST", fields[1])
+	}
+	if fields[2] != "/api/echo?x=1" {
+		t.Errorf("path = %s, want /api/echo?x=1", fields[2])
+	}
+	if fields[3] != "200" {
+		t.Errorf("status = %s, want 200", fields[3])
+	}
+	if fields[4] != strconv.Itoa(len(raw)) {
+		t.Errorf("bytes = %s, want the %d bytes sent", fields[4], len(raw))
+	}
+	if duration, err := time.ParseDuration(fields[5]); err != nil || duration <= 0 {
+		t.Errorf("duration = %s, want a positive duration", fields[5])
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestServer(t, Config{LogFormat: "json"})
+	raw, line := loggedRequest(t, s, logs, loggedRequestLine)
+	
+	var entry struct {
+		Time       string   `json:"time"`
+		RequestID  string   `json:"request_id"`
+		Method     string   `json:"method"`
+		Path       string   `json:"path"`
+		Status     int      `json:"status"`
+		Bytes      int      `json:"bytes"`
+		DurationMS *float64 `json:"duration_ms"`
+	}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+		t.Fatalf("access log line %q isn't JSON: %v", line, err)
+	}
+	if entry.Method != "POST" || entry.Path != "/api/echo?x=1" || entry.Status != 200 {
+		t.Errorf("logged %s %s %d, want POST /api/echo?x=1 200", entry.Method, entry.Path, entry.Status)
+	}
+	if entry.Bytes != len(raw) {
+		t.Errorf("bytes = %d, want the %d bytes sent", entry.Bytes, len(raw))
+	}
+	if entry.DurationMS == nil || *entry.DurationMS < 0 {
+		t.Errorf("duration_ms = %v, want a duration", entry.DurationMS)
+	}
+	if entry.RequestID == "" || !strings.Contains(raw, "X-Request-ID: "+entry.RequestID) {
+		t.Errorf("request_id %q doesn't match the response's X-Request-ID", entry.RequestID)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry.Time); err != nil {
+		t.Errorf("time = %q: %v", entry.Time, err)
+	}
+}
@@ -4,27 +4,42 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"html"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/textproto"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-// Config represents server configuration
-type Config struct {
-	Port      string
-	Directory string
-}
+// httpTimeFormat is the preferred date format for HTTP headers (IMF-fixdate)
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
 
 // Session represents a user session
 type Session struct {
@@ -85,222 +100,738 @@ func (sm *SessionManager) CleanupSessions() {
 	}
 }
 
+// DirectoryEntry describes a file in a JSON directory listing
+type DirectoryEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	IsDir    bool   `json:"is_dir"`
+	Modified string `json:"modified"`
+}
+
 // Server represents our HTTP server
 type Server struct {
 	config         Config
 	sessionManager *SessionManager
-	listener       net.Listener
+	rateLimiter    *RateLimiter
+	metrics        *Metrics
+	metadata       *MetadataStore
+	fileCache      *FileCache
+	// trustedProxies are the peers whose X-Forwarded-For is believed
+	trustedProxies []netip.Prefix
+	router         *Router
+	// virtualHosts maps lowercased host names to the routers serving them
+	virtualHosts map[string]*Router
+	listener     net.Listener
+	debugServer  *http.Server
+	// connSlots bounds concurrent connection handlers when MaxConnections is set
+	connSlots chan struct{}
+	// ready is set once the listener is bound and the files directory exists
+	ready atomic.Bool
+	// draining is set once Stop begins, and stopping is closed at the same time so
+	// long-lived responses such as event streams can end
+	draining atomic.Bool
+	stopping chan struct{}
+	// connWG counts connection handlers so Shutdown can wait for them, and
+	// conns maps each open connection to whether it is idle between requests
+	connWG    sync.WaitGroup
+	connMutex sync.Mutex
+	conns     map[net.Conn]bool
+	// uploads maps file paths to the resumable uploads in progress for them
+	uploadMutex sync.Mutex
+	uploads     map[string]*resumableUpload
 }
 
 // NewServer creates a new server with the given config
 func NewServer(config Config) *Server {
-	return &Server{
+	server := &Server{
 		config:         config,
 		sessionManager: NewSessionManager(),
+		metrics:        NewMetrics(),
+		metadata:       NewMetadataStore(filepath.Join(config.Directory, ".files-metadata.json")),
+		conns:          make(map[net.Conn]bool),
+		stopping:       make(chan struct{}),
+		uploads:        make(map[string]*resumableUpload),
+	}
+	// Bad proxy ranges are left for Validate to report when the server starts
+	server.trustedProxies, _ = parseTrustedProxies(config.TrustedProxies)
+	server.router = server.routes()
+	if config.EmbeddedAssets {
+		assets, _ := fs.Sub(staticFiles, "static")
+		if err := server.MountFS("/static", assets); err != nil {
+			log.Printf("Error mounting embedded assets: %v", err)
+		}
+	}
+	// Bad upstream URLs are left for Validate to report when the server starts
+	for prefix, upstream := range config.ProxyRoutes {
+		server.ProxyRoute(prefix, upstream)
+	}
+	for host, upstream := range config.VirtualHosts {
+		server.virtualHostProxy(host, upstream)
+	}
+	if config.MaxConnections > 0 {
+		server.connSlots = make(chan struct{}, config.MaxConnections)
 	}
+	if config.RateLimit > 0 {
+		server.rateLimiter = NewRateLimiter(config.RateLimit, config.RateBurst)
+	}
+	if config.CacheBytes > 0 {
+		server.fileCache = NewFileCache(config.CacheBytes)
+	}
+	return server
+}
+
+// Set not found handler customizes the response for unknown paths, e.g. to
+// serve a branded HTML page or a JSON error
+func (s *Server) SetNotFoundHandler(h HandlerFunc) {
+	s.router.SetNotFoundHandler(h)
 }
 
-// Start starts the server
+// Start starts the server. It returns nil once Stop or Shutdown closes the listener.
 func (s *Server) Start() error {
-	log.Printf("Starting web server on port %s...", s.config.Port)
+	if err := s.config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	
+	address := net.JoinHostPort(s.config.BindAddress, s.config.Port)
+	log.Printf("Starting web server on %s...", address)
 	log.Printf("Serving files from: %s", filepath.Join(s.config.Directory, "files"))
 	
 	// Ensure the files directory exists
 	filesDir := filepath.Join(s.config.Directory, "files")
 	os.MkdirAll(filesDir, 0755)
+	removeOrphanedUploads(filesDir)
 	
 	var err error
-	s.listener, err = net.Listen("tcp", "0.0.0.0:"+s.config.Port)
+	s.listener, err = s.listen(address)
 	if err != nil {
-		return fmt.Errorf("failed to bind to port %s: %v", s.config.Port, err)
+		return fmt.Errorf("failed to bind to %s: %v", address, err)
+	}
+	
+	if s.config.EnablePprof {
+		s.startPprof()
 	}
 	
-	// Start session cleanup routine
+	s.ready.Store(true)
+	
+	// Start session, upload and rate limiter cleanup routine
 	go func() {
 		for {
 			time.Sleep(5 * time.Minute)
 			s.sessionManager.CleanupSessions()
+			s.expireUploads(staleUploadAge)
+			if s.rateLimiter != nil {
+				s.rateLimiter.CleanupBuckets()
+			}
 		}
 	}()
 	
+	// In worker pool mode a fixed set of goroutines takes connections in turn. Each
+	// worker stays with a connection until it closes, so accepting waits while all
+	// of them are busy.
+	var queue chan net.Conn
+	if s.config.Workers > 0 {
+		queue = make(chan net.Conn)
+		defer close(queue)
+		for i := 0; i < s.config.Workers; i++ {
+			go func() {
+				for conn := range queue {
+					s.serveConn(conn)
+				}
+			}()
+		}
+		log.Printf("Serving connections with %d workers", s.config.Workers)
+	}
+	
 	// Accept connections
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if s.draining.Load() {
+				return nil
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
-		go s.handleConnection(conn)
+		
+		s.trackConn(conn)
+		
+		// Only hand the connection to a handler if a slot is free
+		if s.connSlots != nil {
+			select {
+			case s.connSlots <- struct{}{}:
+			default:
+				go func() {
+					defer s.untrackConn(conn)
+					rejectConnection(conn)
+				}()
+				continue
+			}
+		}
+		
+		if queue != nil {
+			queue <- conn
+		} else {
+			go s.serveConn(conn)
+		}
+	}
+}
+
+// Serve conn handles a connection, then frees its slot and stops tracking it
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrackConn(conn)
+	if s.connSlots != nil {
+		defer func() { <-s.connSlots }()
+	}
+	s.handleConnection(conn)
+}
+
+// Reject connection tells a client the server is at capacity and closes the connection
+func rejectConnection(rawConn net.Conn) {
+	conn := newBufferedConn(rawConn)
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	headers := Header{"Retry-After": {"1"}, "Connection": {"close"}}
+	writeError(conn, 503, "Server busy", headers, "")
+}
+
+// Listen opens the server's listener, wrapping it in TLS when a certificate is configured
+func (s *Server) listen(address string) (net.Listener, error) {
+	if !s.config.TLSEnabled() {
+		return net.Listen("tcp", address)
+	}
+	
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
 	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	log.Printf("TLS enabled with certificate %s", s.config.TLSCertFile)
+	return tls.Listen("tcp", address, tlsConfig)
 }
 
 // Stop stops the server
 func (s *Server) Stop() error {
+	if s.draining.CompareAndSwap(false, true) {
+		close(s.stopping)
+	}
+	s.ready.Store(false)
+	if s.debugServer != nil {
+		s.debugServer.Close()
+	}
 	if s.listener != nil {
 		return s.listener.Close()
 	}
 	return nil
 }
 
+// Shutdown stops accepting connections, closes idle keep-alive connections and
+// waits for the rest to finish their current request. If ctx ends first, the
+// remaining connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.Stop(); err != nil {
+		log.Printf("Error closing listener: %v", err)
+	}
+	
+	// Busy connections close themselves after their current response
+	s.connMutex.Lock()
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.connMutex.Unlock()
+	
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.connMutex.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.connMutex.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Track conn registers a connection before its handler starts
+func (s *Server) trackConn(conn net.Conn) {
+	s.connWG.Add(1)
+	s.connMutex.Lock()
+	s.conns[conn] = true
+	s.connMutex.Unlock()
+}
+
+// Set conn idle marks a connection as waiting for its next request or busy with
+// one. Going idle fails once shutdown has begun, and the caller should close the
+// connection instead of reading another request.
+func (s *Server) setConnIdle(conn net.Conn, idle bool) bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if idle && s.draining.Load() {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+// Untrack conn forgets a connection once its handler has returned
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connMutex.Lock()
+	delete(s.conns, conn)
+	s.connMutex.Unlock()
+	s.connWG.Done()
+}
+
 // Handle connection processes each incoming connection
-func (s *Server) handleConnection(conn net.Conn) {
+func (s *Server) handleConnection(rawConn net.Conn) {
+	// Buffer writes so each response goes out in a single write; Close flushes
+	// anything still buffered, including on error paths
+	conn := newBufferedConn(rawConn)
 	defer conn.Close()
-	reader := bufio.NewReader(conn)
+	s.metrics.activeConnections.Add(1)
+	defer s.metrics.activeConnections.Add(-1)
+	reader := bufio.NewReader(rawConn)
 	
-	for {
-		// Read request line
-		requestLine, err := reader.ReadString('\n')
+	// Every request's context derives from this one, so all are cancelled once the connection closes
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	defer cancelConn()
+	
+	for requests := 1; ; requests++ {
+		// Stop between requests once shutdown has begun
+		if !s.setConnIdle(rawConn, true) {
+			break
+		}
+		
+		// Read request line, giving up on connections left idle for too long
+		if s.config.IdleTimeout > 0 {
+			rawConn.SetReadDeadline(time.Now().Add(time.Duration(s.config.IdleTimeout)))
+		}
+		requestLine, err := readLine(reader, s.config.MaxRequestLine)
+		if err == errLineTooLong {
+			writeError(conn, 414, "URI Too Long", Header{"Connection": {"close"}}, "")
+			break
+		}
 		if err != nil {
 			break
 		}
-		requestLine = strings.TrimSpace(requestLine)
+		s.setConnIdle(rawConn, false)
+		if s.config.IdleTimeout > 0 {
+			rawConn.SetReadDeadline(time.Time{})
+		}
+		requestLine = strings.TrimRight(requestLine, "\r\n")
 		if requestLine == "" {
-			continue
+			// Tolerate a single empty line before the request line, as RFC 9112 suggests
+			requestLine, err = readLine(reader, s.config.MaxRequestLine)
+			if err == errLineTooLong {
+				writeError(conn, 414, "URI Too Long", Header{"Connection": {"close"}}, "")
+				break
+			}
+			if err != nil {
+				break
+			}
+			requestLine = strings.TrimRight(requestLine, "\r\n")
 		}
+		start := time.Now()
 		
 		// Parse request line
-		parts := strings.Split(requestLine, " ")
-		if len(parts) < 3 {
-			sendResponse(conn, 400, "Bad Request", "text/plain", []byte("Bad Request"), nil, false, true)
+		method, target, version, status := parseRequestLine(requestLine)
+		if status == 505 {
+			writeError(conn, 505, "HTTP Version Not Supported", Header{"Connection": {"close"}}, "")
+			break
+		}
+		if status != 0 {
+			writeError(conn, 400, "Bad Request", Header{"Connection": {"close"}}, "")
 			break
 		}
-		method := parts[0]
-		path := parts[1]
+		
+		// Split the query string off the request target
+		path, rawQuery, _ := strings.Cut(target, "?")
+		query, _ := url.ParseQuery(rawQuery)
+		path = normalizePath(path)
 		
 		// Parse headers
-		headers, err := parseHeaders(reader)
+		headers, headerFields, err := parseHeaders(reader)
 		if err != nil {
 			break
 		}
 		
-		// Read body if present
-		var body []byte
-		if clStr, ok := headers["Content-Length"]; ok {
-			cl, _ := strconv.Atoi(clStr)
-			body = make([]byte, cl)
-			io.ReadFull(reader, body)
+		// Answer Expect before the client sends the body. HTTP/1.0 clients can't
+		// send it meaningfully, so their expectations are ignored.
+		if expect, ok := headers["Expect"]; ok && version != "HTTP/1.0" {
+			if !s.expectContinue(conn, expect, headers["Content-Length"], headers["Accept"]) {
+				break
+			}
 		}
 		
-		// Determine if connection should close
-		closeConn := strings.ToLower(headers["Connection"]) == "close"
-		clientSupportsGzip := supportsGzip(headers["Accept-Encoding"])
+		// Read the whole body, so a pipelined request that follows starts at its request line
+		body, status, err := s.readBody(reader, headers)
+		if err != nil {
+			// Handling a truncated body could act on half an upload, so drop the request
+			log.Printf("Dropping %s %s from %s: %v", method, target, remoteIP(rawConn), err)
+			break
+		}
+		if status != 0 {
+			writeError(conn, status, http.StatusText(status), Header{"Connection": {"close"}}, headers["Accept"])
+			break
+		}
 		
-		// Handle session
-		responseHeaders := make(map[string]string)
-		sessionID := getSessionCookie(headers["Cookie"])
+		// Determine if connection should close. HTTP/1.0 closes by default and only
+		// stays open when the client asks for keep-alive.
+		proto := "HTTP/1.1"
+		closeConn := hasToken(headers["Connection"], "close")
+		if version == "HTTP/1.0" {
+			proto = version
+			closeConn = !hasToken(headers["Connection"], "keep-alive")
+		}
+		// Tell the client this is the last response when shutting down or when the
+		// connection has used up its request allowance
+		closeConn = closeConn || s.draining.Load()
+		if s.config.MaxRequestsPerConn > 0 && requests >= s.config.MaxRequestsPerConn {
+			closeConn = true
+		}
+		clientSupportsGzip := supportsGzip(headers["Accept-Encoding"])
+		clientIP := s.clientIP(headers, conn.RemoteAddr())
 		
-		if sessionID == "" {
-			sessionID = s.sessionManager.CreateSession()
-			responseHeaders["Set-Cookie"] = fmt.Sprintf("session=%s; Path=/", sessionID)
-		} else if _, exists := s.sessionManager.GetSession(sessionID); exists {
-			// Update session time
-			s.sessionManager.UpdateSession(sessionID)
-		} else {
-			// Invalid session, create new one
-			sessionID = s.sessionManager.CreateSession()
-			responseHeaders["Set-Cookie"] = fmt.Sprintf("session=%s; Path=/", sessionID)
+		// Track the status and size of the response for the access log
+		response := &responseTracker{
+			Conn:  conn,
+			proto: proto,
 		}
+		requestID := requestIDFromHeader(headers["X-Request-Id"])
+		connHeaders := s.connectionHeaders(closeConn)
 		
-		// Add security headers
-		responseHeaders["X-Content-Type-Options"] = "nosniff"
-		responseHeaders["X-Frame-Options"] = "DENY"
-		responseHeaders["X-XSS-Protection"] = "1; mode=block"
+		// Handle the request
+		switch {
+		case method != "TRACE" && (path == "/healthz" || path == "/readyz"):
+			// Probes skip sessions and rate limiting so they stay cheap
+			s.handleProbe(response, path, connHeaders, closeConn)
+			
+		case method != "TRACE" && path == "/metrics":
+			s.handleMetrics(response, connHeaders, closeConn)
+			
+		case !s.allowRequest(response, clientIP, requestID, headers["Accept"], connHeaders):
+			// Rate limited; the 429 has already been sent
+			
+		default:
+			responseHeaders := s.newResponseHeaders(headers)
+			responseHeaders.Set("X-Request-ID", requestID)
+			for key, values := range connHeaders {
+				responseHeaders[key] = values
+			}
+			ctx := context.WithValue(connCtx, requestIDKey{}, requestID)
+			if form, err := parseForm(headers["Content-Type"], body); form != nil || err != nil {
+				ctx = context.WithValue(ctx, formKey{}, parsedForm{form: form, err: err})
+			}
+			ctx, cancel := context.WithCancel(ctx)
+			stopWatching := watchDisconnect(rawConn, reader, cancel)
+			response.takeOver = func() *bufio.Reader {
+				stopWatching()
+				return reader
+			}
+			s.handleRequest(response, &Request{
+				Method:          method,
+				Path:            path,
+				Query:           query,
+				Headers:         headers,
+				HeaderFields:    headerFields,
+				RemoteIP:        clientIP,
+				Body:            body,
+				ResponseHeaders: responseHeaders,
+				Gzip:            clientSupportsGzip,
+				Close:           closeConn,
+				ctx:             ctx,
+				started:         response.started,
+			})
+			stopWatching()
+			cancel()
+		}
 		
-		// Log request
-		log.Printf("%s - %s %s", conn.RemoteAddr(), method, path)
+		// Send the buffered response
+		flushErr := conn.Flush()
 		
-		// Handle the request
-		s.handleRequest(conn, method, path, headers, body, responseHeaders, clientSupportsGzip, closeConn)
+		duration := time.Since(start)
+		if path != "/metrics" {
+			s.metrics.ObserveRequest(response.status, response.bytes, duration)
+		}
+		// Probes run every few seconds, so leave them out of the access log
+		if path != "/healthz" && path != "/readyz" {
+			s.logAccess(AccessLogEntry{
+				RequestID: requestID,
+				RemoteIP:  clientIP,
+				Method:    method,
+				Path:      target,
+				Status:    response.status,
+				Bytes:     response.bytes,
+				Duration:  duration,
+			})
+		}
 		
-		// Terminate connection if requested
-		if closeConn {
+		// Terminate connection if requested, the client went away or the handler took it over
+		if closeConn || flushErr != nil || response.hijacked {
 			break
 		}
 	}
 }
 
-// Handle request processes the HTTP request
-func (s *Server) handleRequest(
-	conn net.Conn,
-	method string,
-	path string,
-	headers map[string]string,
-	body []byte,
-	responseHeaders map[string]string,
-	clientSupportsGzip bool,
-	closeConn bool,
-) {
-	switch {
-	case path == "/":
-		sendResponse(conn, 200, "OK", "text/plain", []byte("Welcome to the Go Web Server"), responseHeaders, clientSupportsGzip, closeConn)
-		
-	case strings.HasPrefix(path, "/echo/"):
-		echoString := strings.TrimPrefix(path, "/echo/")
-		sendResponse(conn, 200, "OK", "text/plain", []byte(echoString), responseHeaders, clientSupportsGzip, closeConn)
-		
-	case path == "/user-agent":
-		// FIX 1: Only allow GET method for user-agent endpoint
-		if method != "GET" {
-			sendResponse(conn, 405, "Method Not Allowed", "text/plain", []byte("Method not allowed"), responseHeaders, clientSupportsGzip, closeConn)
-			return
+// Read body consumes a request's body. A chunked body is decoded and its trailer
+// discarded, and a request with neither Content-Length nor Transfer-Encoding has no
+// body. A non-zero status is returned when the body can't be read; the connection
+// can't be reused then, since the next request's start is unknown. When the client
+// closes the connection before sending the whole body, an error saying how much
+// arrived is returned instead, as there is no one left to answer.
+func (s *Server) readBody(reader *bufio.Reader, headers map[string]string) ([]byte, int, error) {
+	// Transfer-Encoding takes precedence over Content-Length, as RFC 9112 requires
+	if te, ok := headers["Transfer-Encoding"]; ok {
+		if !strings.EqualFold(strings.TrimSpace(te), "chunked") {
+			return nil, 501, nil
 		}
-		userAgent := headers["User-Agent"]
-		sendResponse(conn, 200, "OK", "text/plain", []byte(userAgent), responseHeaders, clientSupportsGzip, closeConn)
-		
-	case path == "/api/status":
-		status := map[string]interface{}{
-			"status": "ok",
-			"time":   time.Now().Format(time.RFC3339),
+		chunked := httputil.NewChunkedReader(reader)
+		limited := chunked
+		if s.config.MaxUploadSize > 0 {
+			limited = io.LimitReader(chunked, s.config.MaxUploadSize+1)
 		}
-		jsonResponse, _ := json.Marshal(status)
-		sendResponse(conn, 200, "OK", "application/json", jsonResponse, responseHeaders, clientSupportsGzip, closeConn)
-		
-	case path == "/api/time":
-		timeData := map[string]string{
-			"time": time.Now().Format(time.RFC3339),
+		body, err := io.ReadAll(limited)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, fmt.Errorf("client closed the connection after %d bytes of a chunked body", len(body))
 		}
-		jsonResponse, _ := json.Marshal(timeData)
-		sendResponse(conn, 200, "OK", "application/json", jsonResponse, responseHeaders, clientSupportsGzip, closeConn)
-		
-	case path == "/api/echo":
-		if method != "POST" && method != "PUT" {
-			sendResponse(conn, 405, "Method Not Allowed", "text/plain", []byte("Method not allowed"), responseHeaders, clientSupportsGzip, closeConn)
-			return
+		if err != nil {
+			return nil, 400, nil
 		}
-		contentType := "application/json"
-		sendResponse(conn, 200, "OK", contentType, body, responseHeaders, clientSupportsGzip, closeConn)
-		
-	case path == "/api/session":
-		timestamp, _ := s.sessionManager.GetSession(getSessionCookie(headers["Cookie"]))
-		sessionInfo := map[string]interface{}{
-			"session_id": getSessionCookie(headers["Cookie"]),
-			"created_at": timestamp.Format(time.RFC3339),
-			"age":        time.Since(timestamp).String(),
-		}
-		jsonResponse, _ := json.Marshal(sessionInfo)
-		sendResponse(conn, 200, "OK", "application/json", jsonResponse, responseHeaders, clientSupportsGzip, closeConn)
-		
-	case strings.HasPrefix(path, "/files"):
-		s.handleFiles(conn, method, path, body, responseHeaders, clientSupportsGzip, closeConn)
-		
-	default:
-		sendResponse(conn, 404, "Not Found", "text/plain", []byte("Not Found"), responseHeaders, clientSupportsGzip, closeConn)
+		if s.config.MaxUploadSize > 0 && int64(len(body)) > s.config.MaxUploadSize {
+			return nil, 413, nil
+		}
+		// Skip any trailer fields, up to the blank line that ends the message
+		if _, _, err := parseHeaders(reader); err != nil {
+			return nil, 400, nil
+		}
+		return body, 0, nil
+	}
+	
+	clStr, ok := headers["Content-Length"]
+	if !ok {
+		return nil, 0, nil
+	}
+	cl, err := strconv.ParseInt(strings.TrimSpace(clStr), 10, 64)
+	if err != nil || cl < 0 {
+		return nil, 400, nil
+	}
+	// The buffer grows as the body arrives rather than trusting Content-Length up front
+	body, err := io.ReadAll(io.LimitReader(reader, cl))
+	if err != nil || int64(len(body)) < cl {
+		return nil, 0, fmt.Errorf("client closed the connection after %d of %d body bytes", len(body), cl)
+	}
+	return body, 0, nil
+}
+
+// Watch disconnect cancels a request's context if the client closes the connection
+// while the request is being handled. The returned function stops watching and
+// must be called before reading the next request.
+func watchDisconnect(conn net.Conn, reader *bufio.Reader, cancel context.CancelFunc) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peek doesn't consume anything, so a pipelined request stays buffered for the next read
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+	
+	return func() {
+		// Unblock the peek with a deadline in the past, then clear it
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// Expect continue handles an Expect header. It sends 100 Continue when the body
+// will be accepted and returns true, or sends 417 and returns false when the
+// expectation is unknown or the declared body exceeds the upload limit.
+func (s *Server) expectContinue(conn *bufferedConn, expect string, contentLength string, accept string) bool {
+	refuse := !strings.EqualFold(expect, "100-continue")
+	if cl, err := strconv.ParseInt(contentLength, 10, 64); err == nil && s.config.MaxUploadSize > 0 && cl > s.config.MaxUploadSize {
+		refuse = true
+	}
+	if refuse {
+		writeError(conn, 417, "Expectation Failed", Header{"Connection": {"close"}}, accept)
+		return false
 	}
+	
+	// Flush right away, since the client is waiting for this before sending the body
+	conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+	return conn.Flush() == nil
+}
+
+// Allow request enforces the per-IP rate limit, sending a 429 and returning false
+// when the client has exceeded it
+func (s *Server) allowRequest(conn net.Conn, clientIP string, requestID string, accept string, connHeaders Header) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	allowed, retryAfter := s.rateLimiter.Allow(clientIP)
+	if !allowed {
+		limitHeaders := connHeaders.Clone()
+		limitHeaders.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		limitHeaders.Set("X-Request-ID", requestID)
+		writeError(conn, 429, "Too many requests", limitHeaders, accept)
+	}
+	return allowed
+}
+
+// Handle probe answers the liveness (/healthz) and readiness (/readyz) probes
+func (s *Server) handleProbe(conn net.Conn, path string, headers Header, closeConn bool) {
+	if path == "/healthz" && s.draining.Load() {
+		sendResponse(conn, 503, "Service Unavailable", "text/plain", []byte("draining"), headers, false, closeConn)
+		return
+	}
+	if path == "/readyz" && !s.ready.Load() {
+		sendResponse(conn, 503, "Service Unavailable", "text/plain", []byte("not ready"), headers, false, closeConn)
+		return
+	}
+	sendResponse(conn, 200, "OK", "text/plain", []byte("ok"), headers, false, closeConn)
+}
+
+// Connection headers returns the headers that tell the client what happens to the
+// connection after a response: Connection: close when it is about to be closed, and
+// otherwise how long it may idle in Keep-Alive. Errors sent with these headers close
+// the connection when they should without being told separately.
+func (s *Server) connectionHeaders(closeConn bool) Header {
+	if closeConn {
+		return Header{"Connection": {"close"}}
+	}
+	if s.config.IdleTimeout > 0 {
+		return Header{"Keep-Alive": {fmt.Sprintf("timeout=%d", int(time.Duration(s.config.IdleTimeout).Seconds()))}}
+	}
+	return Header{}
+}
+
+// New response headers starts the header set for a response with the session
+// cookie, when a new session is created
+func (s *Server) newResponseHeaders(headers map[string]string) Header {
+	responseHeaders := make(Header)
+	sessionID := getSessionCookie(headers["Cookie"])
+	
+	if sessionID == "" {
+		sessionID = s.sessionManager.CreateSession()
+		responseHeaders.Set("Set-Cookie", s.sessionCookie(sessionID))
+	} else if _, exists := s.sessionManager.GetSession(sessionID); exists {
+		// Update session time
+		s.sessionManager.UpdateSession(sessionID)
+	} else {
+		// Invalid session, create new one
+		sessionID = s.sessionManager.CreateSession()
+		responseHeaders.Set("Set-Cookie", s.sessionCookie(sessionID))
+	}
+	return responseHeaders
+}
+
+// Session cookie formats the Set-Cookie value for a session, marking it Secure over HTTPS
+func (s *Server) sessionCookie(sessionID string) string {
+	cookie := fmt.Sprintf("session=%s; Path=/", sessionID)
+	if s.config.TLSEnabled() {
+		cookie += "; Secure"
+	}
+	return cookie
+}
+
+// Handle request dispatches the request to its route on the router for its host
+func (s *Server) handleRequest(conn net.Conn, req *Request) {
+	defer recoverPanic(conn, req)
+	handler, params := s.routerFor(req.Headers["Host"]).Match(req.Method, req.Path)
+	req.Params = params
+	handler(conn, req)
+}
+
+// Recover panic, deferred around a handler, keeps a panic from taking the server
+// down. The panic is logged with its stack, the client gets a 500 unless part of a
+// response has already gone out, and the connection is closed since the handler may
+// have left it in any state.
+func recoverPanic(conn net.Conn, req *Request) {
+	err := recover()
+	if err == nil {
+		return
+	}
+	log.Printf("request_id=%s panic serving %s %s: %v\n%s", requestIDFromContext(req.Context()), req.Method, req.Path, err, debug.Stack())
+	if req.started == nil || !req.started() {
+		headers := req.ResponseHeaders.Clone()
+		headers.Set("Connection", "close")
+		writeError(conn, 500, "Internal Server Error", headers, req.Headers["Accept"])
+	}
+	conn.Close()
+}
+
+// Authorized checks the Authorization header against the configured API tokens.
+// Requests are always authorized when no tokens are configured.
+func (s *Server) authorized(authorization string) bool {
+	if len(s.config.APITokens) == 0 {
+		return true
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+	
+	// Compare against every token so timing doesn't reveal which one matched
+	valid := 0
+	for _, candidate := range s.config.APITokens {
+		valid |= subtle.ConstantTimeCompare(token, []byte(candidate))
+	}
+	return valid == 1
 }
 
+// File methods are the methods handleFiles accepts for a path under /files/,
+// and files root methods those it accepts for /files itself. Both are sorted for
+// the Allow header.
+var (
+	fileMethods      = []string{"DELETE", "GET", "PATCH", "POST", "PUT"}
+	filesRootMethods = []string{"DELETE", "GET", "POST"}
+)
+
 // Handle files processes file-related requests
 func (s *Server) handleFiles(
 	conn net.Conn,
 	method string,
 	path string,
+	query url.Values,
+	headers map[string]string,
 	body []byte,
-	responseHeaders map[string]string,
+	responseHeaders Header,
 	clientSupportsGzip bool,
 	closeConn bool,
 ) {
-	// Handle directory listing for /files/ root
+	// Handle form uploads, bulk deletes and the index page or listing for /files/ root
 	if path == "/files" || path == "/files/" {
-		s.handleDirectoryListing(conn, responseHeaders, clientSupportsGzip, closeConn)
+		filesDir := filepath.Join(s.config.Directory, "files")
+		if method == "POST" {
+			// The root has no name to create, so only form uploads can go there
+			if !isMultipart(headers["Content-Type"]) {
+				writeError(conn, 415, "Uploads to /files must be multipart/form-data", responseHeaders, headers["Accept"])
+				return
+			}
+			s.handleMultipartUpload(conn, filesDir, headers["Content-Type"], body, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+			return
+		}
+		if method == "DELETE" {
+			s.handleDeleteAll(conn, filesDir, headers, responseHeaders, clientSupportsGzip, closeConn)
+			return
+		}
+		if method != "GET" && method != "POST" {
+			responseHeaders.Set("Allow", strings.Join(filesRootMethods, ", "))
+			writeError(conn, 405, "Method not allowed", responseHeaders, headers["Accept"])
+			return
+		}
+		s.handleFileGet(conn, filesDir, query, headers, responseHeaders, clientSupportsGzip, closeConn)
 		return
 	}
 	
@@ -311,7 +842,7 @@ func (s *Server) handleFiles(
 	var err error
 	filename, err = url.QueryUnescape(filename)
 	if err != nil {
-		sendResponse(conn, 400, "Bad Request", "text/plain", []byte("Invalid URL encoding"), responseHeaders, clientSupportsGzip, closeConn)
+		writeError(conn, 400, "Invalid URL encoding", responseHeaders, headers["Accept"])
 		return
 	}
 	
@@ -324,166 +855,1037 @@ func (s *Server) handleFiles(
 	absFilePath, _ := filepath.Abs(filePath)
 	
 	// FIX 3: Better path traversal detection
-	// If the file path is not within the files directory, return Forbidden
-	if !strings.HasPrefix(absFilePath, absFilesDir) || strings.Contains(filename, "..") {
-		sendResponse(conn, 403, "Forbidden", "text/plain", []byte("Path traversal not allowed"), responseHeaders, clientSupportsGzip, closeConn)
+	// If the file path is not within the files directory, return Forbidden.
+	// The ".." check is kept as defense in depth.
+	if !isWithinDir(absFilesDir, absFilePath) || strings.Contains(filename, "..") {
+		writeError(conn, 403, "Path traversal not allowed", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	// An encoded name such as %2f can still resolve to the files directory itself,
+	// which must get the root's handling, confirmation for bulk deletes included
+	if absFilePath == absFilesDir {
+		s.handleFiles(conn, method, "/files/", query, headers, body, responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	
+	// A symlink inside the files directory must not lead outside it
+	if escapesViaSymlink(absFilesDir, absFilePath) {
+		writeError(conn, 403, "Path traversal not allowed", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	// Dotfiles such as .env or .htpasswd often hold secrets, so hide them unless enabled
+	if !s.config.ServeDotfiles && hasDotSegment(filename) {
+		writeError(conn, 404, "File not found", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	// Writes share the same upload size limit (PATCH also counts the existing file, see handleFileAppend)
+	if (method == "POST" || method == "PUT") && s.config.MaxUploadSize > 0 && int64(len(body)) > s.config.MaxUploadSize {
+		writeError(conn, 413, "File too large", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	// Conditional writes let clients avoid overwriting each other's changes
+	if (method == "POST" || method == "PUT") && preconditionFailed(headers, filePath) {
+		writeError(conn, 412, "Precondition failed", responseHeaders, headers["Accept"])
 		return
 	}
 	
 	switch method {
 	case "GET":
-		s.handleFileGet(conn, filePath, responseHeaders, clientSupportsGzip, closeConn)
+		if query.Get("meta") == "1" {
+			s.handleFileMeta(conn, filePath, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+			return
+		}
+		s.handleFileGet(conn, filePath, query, headers, responseHeaders, clientSupportsGzip, closeConn)
 		
 	case "POST":
-		s.handleFileCreate(conn, filePath, body, responseHeaders, clientSupportsGzip, closeConn)
+		// Form uploads treat the target path as the destination directory
+		if isMultipart(headers["Content-Type"]) {
+			s.handleMultipartUpload(conn, filePath, headers["Content-Type"], body, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+			return
+		}
+		contentType := uploadContentType(query.Get("content_type"), headers["Content-Type"])
+		s.handleFileCreate(conn, filePath, body, contentType, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+		
+	case "PUT":
+		contentType := uploadContentType(query.Get("content_type"), headers["Content-Type"])
+		if contentRange := headers["Content-Range"]; contentRange != "" {
+			s.handleFileUploadRange(conn, filePath, contentRange, body, contentType, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+			return
+		}
+		s.handleFilePut(conn, filePath, body, contentType, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
+		
+	case "PATCH":
+		s.handleFileAppend(conn, filePath, body, responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
 		
 	case "DELETE":
-		s.handleFileDelete(conn, filePath, responseHeaders, clientSupportsGzip, closeConn)
+		s.handleFileDelete(conn, filePath, query.Get("recursive") == "1", responseHeaders, headers["Accept"], clientSupportsGzip, closeConn)
 		
 	default:
-		sendResponse(conn, 405, "Method Not Allowed", "text/plain", []byte("Method not allowed"), responseHeaders, clientSupportsGzip, closeConn)
+		responseHeaders.Set("Allow", strings.Join(fileMethods, ", "))
+		writeError(conn, 405, "Method not allowed", responseHeaders, headers["Accept"])
 	}
 }
 
-// Handle directory listing shows files in the files directory
+// Handle directory listing shows files in the files directory or one of its subdirectories
 func (s *Server) handleDirectoryListing(
 	conn net.Conn,
-	responseHeaders map[string]string,
+	dirPath string,
+	headers map[string]string,
+	responseHeaders Header,
 	clientSupportsGzip bool,
 	closeConn bool,
 ) {
+	if !s.config.EnableDirectoryListing {
+		writeError(conn, 403, "Directory listing disabled", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		writeError(conn, 500, "Error reading directory", responseHeaders, headers["Accept"])
+		return
+	}
+	if !s.config.ServeDotfiles {
+		visible := files[:0]
+		for _, file := range files {
+			if !strings.HasPrefix(file.Name(), ".") {
+				visible = append(visible, file)
+			}
+		}
+		files = visible
+	}
+	
+	// Programmatic clients can ask for a JSON listing instead of HTML
+	if negotiateContentType(headers["Accept"], "text/html", "application/json") == "application/json" {
+		entries := make([]DirectoryEntry, 0, len(files))
+		for _, file := range files {
+			entries = append(entries, DirectoryEntry{
+				Name:     file.Name(),
+				Size:     file.Size(),
+				IsDir:    file.IsDir(),
+				Modified: file.ModTime().UTC().Format(time.RFC3339),
+			})
+		}
+		writeJSON(conn, 200, entries, responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	
+	// Build links from the directory's URL path relative to the files root
 	filesDir := filepath.Join(s.config.Directory, "files")
-	files, err := ioutil.ReadDir(filesDir)
+	relDir, err := filepath.Rel(filesDir, dirPath)
 	if err != nil {
-		sendResponse(conn, 500, "Internal Server Error", "text/plain", []byte("Error reading directory"), responseHeaders, clientSupportsGzip, closeConn)
+		writeError(conn, 500, "Error reading directory", responseHeaders, headers["Accept"])
 		return
 	}
+	urlPath := "/files/"
+	if relDir != "." {
+		urlPath += filepath.ToSlash(relDir) + "/"
+	}
 	
 	var fileList bytes.Buffer
 	fileList.WriteString("<html><head><title>Directory Listing</title></head><body>")
-	fileList.WriteString("<h1>Directory Listing</h1><ul>")
+	fileList.WriteString(fmt.Sprintf("<h1>Directory Listing of %s</h1><ul>", html.EscapeString(urlPath)))
+	
+	// The parent link never leads above the files root
+	if relDir != "." {
+		parentPath := "/files/"
+		if parent := filepath.Dir(relDir); parent != "." {
+			parentPath += filepath.ToSlash(parent) + "/"
+		}
+		fileList.WriteString(fmt.Sprintf("<li><a href=\"%s\">..</a></li>", html.EscapeString(escapeURLPath(parentPath))))
+	}
 	
+	// Names can contain markup or URL syntax, so escape them for both the link and its text
 	for _, file := range files {
-		fileList.WriteString(fmt.Sprintf("<li><a href=\"/files/%s\">%s</a></li>", file.Name(), file.Name()))
+		name := file.Name()
+		if file.IsDir() {
+			name += "/"
+		}
+		href := escapeURLPath(urlPath + name)
+		fileList.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a></li>", html.EscapeString(href), html.EscapeString(name)))
 	}
 	
 	fileList.WriteString("</ul></body></html>")
-	sendResponse(conn, 200, "OK", "text/html", fileList.Bytes(), responseHeaders, clientSupportsGzip, closeConn)
+	sendResponse(conn, 200, "OK", "text/html", fileList.Bytes(), s.withHTMLHeaders("text/html", responseHeaders), clientSupportsGzip, closeConn)
+}
+
+// Escape URL path percent-encodes each segment of a slash-separated path. "+" is
+// encoded too, since file paths are decoded with query unescaping.
+func escapeURLPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
 }
 
 // Handle file get retrieves a file
 func (s *Server) handleFileGet(
 	conn net.Conn,
 	filePath string,
-	responseHeaders map[string]string,
+	query url.Values,
+	headers map[string]string,
+	responseHeaders Header,
 	clientSupportsGzip bool,
 	closeConn bool,
 ) {
-	fileData, err := ioutil.ReadFile(filePath)
+	info, err := os.Stat(filePath)
 	if err != nil {
-		sendResponse(conn, 404, "Not Found", "text/plain", []byte("File not found"), responseHeaders, clientSupportsGzip, closeConn)
+		writeError(conn, 404, "File not found", responseHeaders, headers["Accept"])
 		return
 	}
 	
-	// Try to determine content type
-	contentType := "application/octet-stream"
-	ext := filepath.Ext(filePath)
-	if ext == ".txt" {
-		contentType = "text/plain"
-	} else if ext == ".html" {
-		contentType = "text/html"
-	} else if ext == ".json" {
-		contentType = "application/json"
+	// Serve a directory's index page when it has one, otherwise list it
+	if info.IsDir() {
+		indexPath, indexInfo, ok := s.findIndexFile(filePath)
+		if !ok {
+			s.handleDirectoryListing(conn, filePath, headers, responseHeaders, clientSupportsGzip, closeConn)
+			return
+		}
+		filePath, info = indexPath, indexInfo
 	}
 	
-	sendResponse(conn, 200, "OK", contentType, fileData, responseHeaders, clientSupportsGzip, closeConn)
-}
-
-// Handle file create creates or updates a file
-func (s *Server) handleFileCreate(
-	conn net.Conn,
-	filePath string,
-	body []byte,
-	responseHeaders map[string]string,
-	clientSupportsGzip bool,
-	closeConn bool,
-) {
-	err := ioutil.WriteFile(filePath, body, 0644)
-	if err != nil {
-		sendResponse(conn, 500, "Internal Server Error", "text/plain", []byte("Error writing file"), responseHeaders, clientSupportsGzip, closeConn)
+	// Tell caches how long they may keep the file; revalidation goes by ETag as usual
+	if cacheControl := s.staticCacheControl(filepath.Base(filePath)); cacheControl != "" {
+		responseHeaders.Set("Cache-Control", cacheControl)
+	}
+	
+	// A precompressed <file>.gz next to the file is sent as is to clients that accept gzip
+	sidecarPath, sidecarInfo, hasSidecar := s.findGzipSidecar(filePath)
+	if hasSidecar {
+		responseHeaders.Set("Vary", "Accept-Encoding")
+	}
+	if hasSidecar && clientSupportsGzip {
+		s.handleGzipSidecar(conn, filePath, sidecarPath, sidecarInfo, query, headers, responseHeaders, closeConn)
 		return
 	}
 	
-	sendResponse(conn, 201, "Created", "text/plain", []byte("File created"), responseHeaders, clientSupportsGzip, closeConn)
-}
-
-// Handle file delete removes a file
-func (s *Server) handleFileDelete(
-	conn net.Conn,
-	filePath string,
-	responseHeaders map[string]string,
-	clientSupportsGzip bool,
-	closeConn bool,
-) {
-	err := os.Remove(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			sendResponse(conn, 404, "Not Found", "text/plain", []byte("File not found"), responseHeaders, clientSupportsGzip, closeConn)
-		} else {
-			sendResponse(conn, 500, "Internal Server Error", "text/plain", []byte("Error deleting file"), responseHeaders, clientSupportsGzip, closeConn)
+	// Let clients revalidate cached copies
+	etag := generateETag(info)
+	responseHeaders.Set("ETag", etag)
+	responseHeaders.Set("Last-Modified", info.ModTime().UTC().Format(httpTimeFormat))
+	if notModified(headers, etag, info.ModTime()) {
+		sendResponse(conn, 304, "Not Modified", "", nil, responseHeaders, false, closeConn)
+		return
+	}
+	
+	// Ask browsers to save rather than render the file
+	if query.Get("download") == "1" {
+		responseHeaders.Set("Content-Disposition", contentDisposition(filepath.Base(filePath)))
+	}
+	
+	// Serve from memory if this version of the file is cached
+	if content, contentType, ok := s.fileCache.Get(filePath, etag); ok {
+		if err := s.serveContent(conn, bytes.NewReader(content), int64(len(content)), contentType, etag, headers, responseHeaders, clientSupportsGzip, closeConn); err != nil {
+			log.Printf("Error streaming %s: %v", filePath, err)
 		}
 		return
 	}
 	
-	sendResponse(conn, 200, "OK", "text/plain", []byte("File deleted"), responseHeaders, clientSupportsGzip, closeConn)
-}
-
-// Helper functions
-
-// Parse headers parses HTTP headers from reader
-func parseHeaders(reader *bufio.Reader) (map[string]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		writeError(conn, 404, "File not found", responseHeaders, headers["Accept"])
+		return
+	}
+	defer file.Close()
+	
+	// Sniff the content type from the head of the file, then rewind for the copy
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeError(conn, 500, "Error reading file", responseHeaders, headers["Accept"])
+		return
+	}
+	contentType := s.contentTypeFor(filePath, head[:n])
+	
+	// Files that fit in the cache are read whole so the next request can skip the disk
+	var body io.ReadSeeker = file
+	size := info.Size()
+	if s.fileCache.Fits(size) {
+		content, err := io.ReadAll(file)
+		if err != nil {
+			writeError(conn, 500, "Error reading file", responseHeaders, headers["Accept"])
+			return
+		}
+		s.fileCache.Put(filePath, etag, content, contentType)
+		body = bytes.NewReader(content)
+		size = int64(len(content))
+	}
+	
+	if err := s.serveContent(conn, body, size, contentType, etag, headers, responseHeaders, clientSupportsGzip, closeConn); err != nil {
+		log.Printf("Error streaming %s: %v", filePath, err)
+	}
+}
+
+// Find gzip sidecar returns the precompressed <filePath>.gz, if there is one that
+// is a regular file and doesn't lead outside the files directory
+func (s *Server) findGzipSidecar(filePath string) (string, os.FileInfo, bool) {
+	if strings.HasSuffix(filePath, ".gz") {
+		return "", nil, false
+	}
+	sidecarPath := filePath + ".gz"
+	info, err := os.Stat(sidecarPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil, false
+	}
+	absFilesDir, err := filepath.Abs(filepath.Join(s.config.Directory, "files"))
+	if err != nil {
+		return "", nil, false
+	}
+	absSidecarPath, err := filepath.Abs(sidecarPath)
+	if err != nil || escapesViaSymlink(absFilesDir, absSidecarPath) {
+		return "", nil, false
+	}
+	return sidecarPath, info, true
+}
+
+// Handle gzip sidecar serves a file's precompressed sidecar with Content-Encoding: gzip,
+// labelled with the content type of the file itself
+func (s *Server) handleGzipSidecar(
+	conn net.Conn,
+	filePath string,
+	sidecarPath string,
+	sidecarInfo os.FileInfo,
+	query url.Values,
+	headers map[string]string,
+	responseHeaders Header,
+	closeConn bool,
+) {
+	// The compressed bytes differ from the file's, so they get an ETag of their own
+	etag := strings.TrimSuffix(generateETag(sidecarInfo), "\"") + "-gzip\""
+	responseHeaders.Set("ETag", etag)
+	responseHeaders.Set("Last-Modified", sidecarInfo.ModTime().UTC().Format(httpTimeFormat))
+	if notModified(headers, etag, sidecarInfo.ModTime()) {
+		sendResponse(conn, 304, "Not Modified", "", nil, responseHeaders, false, closeConn)
+		return
+	}
+	
+	// Sniff the content type from the uncompressed file
+	file, err := os.Open(filePath)
+	if err != nil {
+		writeError(conn, 404, "File not found", responseHeaders, headers["Accept"])
+		return
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	file.Close()
+	contentType := s.contentTypeFor(filePath, head[:n])
+	
+	if query.Get("download") == "1" {
+		responseHeaders.Set("Content-Disposition", contentDisposition(filepath.Base(filePath)))
+	}
+	
+	sidecar, err := os.Open(sidecarPath)
+	if err != nil {
+		writeError(conn, 404, "File not found", responseHeaders, headers["Accept"])
+		return
+	}
+	defer sidecar.Close()
+	
+	responseHeaders.Set("Content-Encoding", "gzip")
+	responseHeaders = s.withHTMLHeaders(contentType, responseHeaders)
+	if err := sendStream(conn, 200, "OK", contentType, sidecar, sidecarInfo.Size(), responseHeaders, false, closeConn); err != nil {
+		log.Printf("Error streaming %s: %v", sidecarPath, err)
+	}
+}
+
+// FileMeta describes a file without its content
+type FileMeta struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Modified    string `json:"modified"`
+	ContentType string `json:"content_type"`
+}
+
+// Find index file returns the index.html inside dir, if there is one that is a
+// regular file and doesn't lead outside the files directory
+func (s *Server) findIndexFile(dir string) (string, os.FileInfo, bool) {
+	indexPath := filepath.Join(dir, "index.html")
+	info, err := os.Stat(indexPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil, false
+	}
+	absFilesDir, err := filepath.Abs(filepath.Join(s.config.Directory, "files"))
+	if err != nil {
+		return "", nil, false
+	}
+	absIndexPath, err := filepath.Abs(indexPath)
+	if err != nil || escapesViaSymlink(absFilesDir, absIndexPath) {
+		return "", nil, false
+	}
+	return indexPath, info, true
+}
+
+// Handle file meta returns a file's metadata as JSON without sending its content
+func (s *Server) handleFileMeta(
+	conn net.Conn,
+	filePath string,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		writeError(conn, 404, "File not found", responseHeaders, accept)
+		return
+	}
+	
+	contentType := "inode/directory"
+	if !info.IsDir() {
+		file, err := os.Open(filePath)
+		if err != nil {
+			writeError(conn, 404, "File not found", responseHeaders, accept)
+			return
+		}
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		file.Close()
+		contentType = s.contentTypeFor(filePath, head[:n])
+	}
+	
+	meta := FileMeta{
+		Name:        info.Name(),
+		Size:        info.Size(),
+		Modified:    info.ModTime().UTC().Format(time.RFC3339),
+		ContentType: contentType,
+	}
+	writeJSON(conn, 200, meta, responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Handle file create creates a new file, refusing to overwrite an existing one.
+// A non-empty contentType is remembered and served back on GET.
+func (s *Server) handleFileCreate(
+	conn net.Conn,
+	filePath string,
+	body []byte,
+	contentType string,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	// Create any missing parent directories so files can be uploaded into subdirectories
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	
+	// POST only creates; overwriting an existing file is left to PUT
+	if _, err := os.Lstat(filePath); err == nil {
+		writeError(conn, 409, "File already exists", responseHeaders, accept)
+		return
+	}
+	_, err := writeFileAtomic(filePath, bytes.NewReader(body), true)
+	if os.IsExist(err) {
+		// Another request created the file while this one was writing
+		writeError(conn, 409, "File already exists", responseHeaders, accept)
+		return
+	}
+	if err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	s.recordContentType(filePath, contentType)
+	
+	sendResponse(conn, 201, "Created", "text/plain", []byte("File created"), responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Handle file put creates or replaces a file, reporting which happened through the status code.
+// The file's remembered content type is replaced by contentType, or forgotten if it is empty.
+func (s *Server) handleFilePut(
+	conn net.Conn,
+	filePath string,
+	body []byte,
+	contentType string,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	info, err := os.Stat(filePath)
+	existed := err == nil
+	if existed && info.IsDir() {
+		writeError(conn, 409, "Target is a directory", responseHeaders, accept)
+		return
+	}
+	
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	if _, err := writeFileAtomic(filePath, bytes.NewReader(body), false); err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	s.recordContentType(filePath, contentType)
+	
+	if existed {
+		sendResponse(conn, 200, "OK", "text/plain", []byte("File replaced"), responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	sendResponse(conn, 201, "Created", "text/plain", []byte("File created"), responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Handle file append appends the request body to a file, creating it if needed,
+// and replies with the file's new size
+func (s *Server) handleFileAppend(
+	conn net.Conn,
+	filePath string,
+	body []byte,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	var existingSize int64
+	info, err := os.Stat(filePath)
+	switch {
+	case err == nil && info.IsDir():
+		writeError(conn, 409, "Path is a directory", responseHeaders, accept)
+		return
+	case err == nil:
+		existingSize = info.Size()
+	case !os.IsNotExist(err):
+		writeError(conn, 500, "Error reading file", responseHeaders, accept)
+		return
+	}
+	created := err != nil
+	
+	if s.config.MaxUploadSize > 0 && existingSize+int64(len(body)) > s.config.MaxUploadSize {
+		writeError(conn, 413, "File too large", responseHeaders, accept)
+		return
+	}
+	
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		writeError(conn, 500, "Error creating directory", responseHeaders, accept)
+		return
+	}
+	
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	_, err = file.Write(body)
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	
+	status := 200
+	if created {
+		status = 201
+	}
+	writeJSON(conn, status, UploadedFile{Name: filepath.Base(filePath), Size: info.Size()}, responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// UploadedFile describes a file stored by a multipart upload or an append
+type UploadedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Handle multipart upload stores each file part of a multipart/form-data body in dirPath
+func (s *Server) handleMultipartUpload(
+	conn net.Conn,
+	dirPath string,
+	contentType string,
+	body []byte,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		writeError(conn, 400, "Invalid multipart boundary", responseHeaders, accept)
+		return
+	}
+	
+	if err := os.MkdirAll(dirPath, 0755); err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	
+	uploaded := []UploadedFile{}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(conn, 400, "Malformed multipart body", responseHeaders, accept)
+			return
+		}
+		
+		// Skip plain form fields
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		
+		name := sanitizeFilename(part.FileName())
+		if name == "" {
+			part.Close()
+			writeError(conn, 400, "Invalid filename", responseHeaders, accept)
+			return
+		}
+		
+		partPath := filepath.Join(dirPath, name)
+		size, err := writeFileAtomic(partPath, part, false)
+		part.Close()
+		if err != nil {
+			writeError(conn, 500, "Error writing file", responseHeaders, accept)
+			return
+		}
+		s.recordContentType(partPath, uploadContentType("", part.Header.Get("Content-Type")))
+		uploaded = append(uploaded, UploadedFile{Name: name, Size: size})
+	}
+	
+	writeJSON(conn, 201, map[string]interface{}{"files": uploaded}, responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Handle file delete removes a file, or a directory if it is empty or recursive is set
+func (s *Server) handleFileDelete(
+	conn net.Conn,
+	filePath string,
+	recursive bool,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	// Lstat so a symlink to a directory is removed as a link, never followed
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(conn, 404, "File not found", responseHeaders, accept)
+		} else {
+			writeError(conn, 500, "Error deleting file", responseHeaders, accept)
+		}
+		return
+	}
+	
+	if info.IsDir() {
+		if recursive {
+			err = os.RemoveAll(filePath)
+		} else if entries, readErr := ioutil.ReadDir(filePath); readErr == nil && len(entries) > 0 {
+			writeError(conn, 409, "Directory not empty; use ?recursive=1", responseHeaders, accept)
+			return
+		} else {
+			err = os.Remove(filePath)
+		}
+		if err != nil {
+			writeError(conn, 500, "Error deleting directory", responseHeaders, accept)
+			return
+		}
+		s.forgetMetadata(filePath)
+		s.fileCache.Invalidate(filePath)
+		sendResponse(conn, 200, "OK", "text/plain", []byte("Directory deleted"), responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	
+	if err := os.Remove(filePath); err != nil {
+		writeError(conn, 500, "Error deleting file", responseHeaders, accept)
+		return
+	}
+	s.forgetMetadata(filePath)
+	s.fileCache.Invalidate(filePath)
+	
+	sendResponse(conn, 200, "OK", "text/plain", []byte("File deleted"), responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Handle delete all empties the files directory. It requires an explicit
+// X-Confirm-Delete: true header so a stray DELETE can't wipe the store.
+func (s *Server) handleDeleteAll(
+	conn net.Conn,
+	filesDir string,
+	headers map[string]string,
+	responseHeaders Header,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	if !strings.EqualFold(headers["X-Confirm-Delete"], "true") {
+		writeError(conn, 400, "Set X-Confirm-Delete: true to delete all files", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	entries, err := ioutil.ReadDir(filesDir)
+	if err != nil {
+		writeError(conn, 500, "Error reading directory", responseHeaders, headers["Accept"])
+		return
+	}
+	
+	deleted := 0
+	for _, entry := range entries {
+		// Hidden entries aren't part of the store unless dotfiles are served
+		if !s.config.ServeDotfiles && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// RemoveAll deletes symlinks themselves rather than what they point to,
+		// so nothing outside the files directory is touched
+		if err := os.RemoveAll(filepath.Join(filesDir, entry.Name())); err != nil {
+			writeError(conn, 500, "Error deleting files", responseHeaders, headers["Accept"])
+			return
+		}
+		s.forgetMetadata(filepath.Join(filesDir, entry.Name()))
+		s.fileCache.Invalidate(filepath.Join(filesDir, entry.Name()))
+		deleted++
+	}
+	
+	sendResponse(conn, 200, "OK", "text/plain", []byte(fmt.Sprintf("Deleted %d entries", deleted)), responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Helper functions
+
+// errLineTooLong is returned by readLine for a line over its limit
+var errLineTooLong = errors.New("line too long")
+
+// Read line reads up to and including the next "\n". It gives up with errLineTooLong
+// as soon as the line passes limit bytes, not counting the line ending, so a client
+// can't make the server buffer an endless line. A limit of 0 means no limit.
+func readLine(reader *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if limit > 0 && len(bytes.TrimRight(line, "\r\n")) > limit {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// Parse request line splits a request line into its method, target and version.
+// It returns a status of 400 for a malformed line, 505 for an HTTP major version
+// other than 1, or 0 when the line is valid.
+func parseRequestLine(line string) (method string, target string, version string, status int) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return "", "", "", 400
+	}
+	method, target, version = parts[0], parts[1], parts[2]
+	
+	if !isToken(method) {
+		return "", "", "", 400
+	}
+	if !validTarget(method, target) {
+		return "", "", "", 400
+	}
+	
+	major, minor, ok := strings.Cut(strings.TrimPrefix(version, "HTTP/"), ".")
+	if !ok || !strings.HasPrefix(version, "HTTP/") || len(major) != 1 || len(minor) != 1 ||
+		!isDigit(major[0]) || !isDigit(minor[0]) {
+		return "", "", "", 400
+	}
+	if major != "1" {
+		return "", "", "", 505
+	}
+	return method, target, version, 0
+}
+
+// Is token reports whether s is a non-empty RFC 9110 token, as used for methods
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0 {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// Is digit reports whether c is an ASCII digit
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// Valid target accepts an origin-form target ("/path?query"), or "*" for OPTIONS
+func validTarget(method string, target string) bool {
+	if target == "*" {
+		return method == "OPTIONS"
+	}
+	if !strings.HasPrefix(target, "/") {
+		return false
+	}
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Normalize path collapses duplicate slashes and resolves "." and ".." segments,
+// including percent-encoded ones such as "%2e%2e", so routing sees one spelling of
+// each path. ".." never climbs above the root, so "/files/../x" routes as "/x" rather
+// than reaching anything under /files. A trailing slash, or a final dot segment, is
+// kept as a trailing slash. Other escapes are left alone for the handlers to decode,
+// as is the "*" target of OPTIONS.
+func normalizePath(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return path
+	}
+	segments := make([]string, 0, strings.Count(path, "/"))
+	trailingSlash := false
+	for _, segment := range strings.Split(path, "/") {
+		trailingSlash = false
+		switch strings.ToLower(segment) {
+		case "":
+			trailingSlash = true
+		case ".", "%2e":
+			trailingSlash = true
+		case "..", ".%2e", "%2e.", "%2e%2e":
+			if len(segments) > 0 {
+				segments = segments[:len(segments)-1]
+			}
+			trailingSlash = true
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	
+	normalized := "/" + strings.Join(segments, "/")
+	if trailingSlash && len(segments) > 0 {
+		normalized += "/"
+	}
+	return normalized
+}
+
+// Has token reports whether a comma-separated header value such as Connection
+// contains token, ignoring case
+func hasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse headers parses HTTP headers from reader. Besides the combined values it
+// returns every field as sent, so repeated fields remain separate values.
+func parseHeaders(reader *bufio.Reader) (map[string]string, map[string][]string, error) {
 	headers := make(map[string]string)
+	fields := make(map[string][]string)
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		line = strings.TrimSpace(line)
 		if line == "" {
 			break
 		}
 		parts := strings.SplitN(line, ": ", 2)
-		if len(parts) == 2 {
-			headers[parts[0]] = parts[1]
+		if len(parts) != 2 {
+			continue
+		}
+		// Header names are case-insensitive, so store them in canonical form
+		name := textproto.CanonicalMIMEHeaderKey(parts[0])
+		fields[name] = append(fields[name], parts[1])
+		existing, repeated := headers[name]
+		if !repeated {
+			headers[name] = parts[1]
+			continue
+		}
+		// A repeated field is combined into one comma-separated list, as RFC 9110
+		// allows; cookies are joined the way a single Cookie header would list them
+		separator := ", "
+		if name == "Cookie" {
+			separator = "; "
+		}
+		headers[name] = existing + separator + parts[1]
+	}
+	return headers, fields, nil
+}
+
+// Is within dir reports whether path is dir itself or lies inside it. Unlike a plain
+// prefix check, this rejects siblings such as /data/files-secret for /data/files.
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) && !filepath.IsAbs(rel)
+}
+
+// Has dot segment reports whether any segment of a slash-separated path starts with a dot
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Escapes via symlink reports whether path, once symlinks are resolved, lies outside dir.
+// For a path that doesn't exist yet, its nearest existing ancestor is checked instead,
+// since a write would create the missing parts beneath it. Dangling symlinks count as
+// escapes because their target can't be verified.
+func escapesViaSymlink(dir string, path string) bool {
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if info, lstatErr := os.Lstat(path); lstatErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+		parent := filepath.Dir(path)
+		if parent == path || !isWithinDir(dir, parent) {
+			return false
 		}
+		return escapesViaSymlink(dir, parent)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return true
+	}
+	return !isWithinDir(resolvedDir, resolvedPath)
+}
+
+// Remote IP returns the IP address of the connection's peer without the port
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
 	}
-	return headers, nil
+	return host
 }
 
 // Get session cookie extracts session ID from cookie header
 func getSessionCookie(cookies string) string {
-	if cookies == "" {
-		return ""
-	}
-	
-	cookieParts := strings.Split(cookies, ";")
-	for _, part := range cookieParts {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(part, "session=") {
-			return strings.TrimPrefix(part, "session=")
+	return parseCookies([]string{cookies})["session"]
+}
+
+// Parse cookies reads the name=value pairs of one or more Cookie header values.
+// Quoted values are unquoted, and pairs without a name or an "=" are skipped. When a
+// name repeats, the first value wins, since browsers send the cookie with the most
+// specific path first.
+func parseCookies(values []string) map[string]string {
+	cookies := make(map[string]string)
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ";") {
+			name, cookieValue, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				continue
+			}
+			cookieValue = strings.TrimSpace(cookieValue)
+			if len(cookieValue) >= 2 && cookieValue[0] == '"' && cookieValue[len(cookieValue)-1] == '"' {
+				cookieValue = cookieValue[1 : len(cookieValue)-1]
+			}
+			if _, seen := cookies[name]; !seen {
+				cookies[name] = cookieValue
+			}
 		}
 	}
-	return ""
+	return cookies
 }
 
-// Generate session ID creates a random session ID
+// Generate session ID creates a random 128-bit session ID, hex encoded
 func generateSessionID() string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 32)
-	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+	return randomHex(16)
+}
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+// Request ID from context returns the ID of the request a context belongs to
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// Request ID from header returns the client's X-Request-ID when it is safe to
+// reuse, or a freshly generated ID otherwise
+func requestIDFromHeader(value string) string {
+	if value == "" || len(value) > 128 {
+		return randomHex(16)
+	}
+	for _, r := range value {
+		// Only allow characters that can't alter log lines or response headers
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return randomHex(16)
+		}
+	}
+	return value
+}
+
+// Random hex returns n cryptographically random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails if the OS entropy source is broken
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// Negotiate content type picks the offer the Accept header ranks highest.
+// Ties go to the earlier offer, and an empty Accept header selects the first offer.
+// It returns "" when the client accepts none of the offers.
+func negotiateContentType(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
 	}
-	return string(b)
+	
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, mediaRange := range strings.Split(accept, ",") {
+			params := strings.Split(mediaRange, ";")
+			rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+			
+			// Exact types beat type/* which beats */*
+			var rangeSpecificity int
+			switch {
+			case rangeType == offer:
+				rangeSpecificity = 2
+			case strings.HasSuffix(rangeType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(rangeType, "*")):
+				rangeSpecificity = 1
+			case rangeType == "*/*":
+				rangeSpecificity = 0
+			default:
+				continue
+			}
+			if rangeSpecificity <= specificity {
+				continue
+			}
+			
+			specificity = rangeSpecificity
+			q = 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
 }
 
 // Supports gzip checks if client supports gzip encoding
@@ -500,86 +1902,421 @@ func supportsGzip(acceptEncoding string) bool {
 	return false
 }
 
-// Send response sends an HTTP response
-func sendResponse(
-	conn net.Conn,
+// Detect content type determines the MIME type of a file from its extension,
+// falling back to sniffing the first 512 bytes of content
+func detectContentType(filePath string, data []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		// System MIME tables may omit the charset for text types
+		if strings.HasPrefix(contentType, "text/") && !strings.Contains(contentType, "charset=") {
+			contentType += "; charset=utf-8"
+		}
+		return contentType
+	}
+	if len(data) > 512 {
+		data = data[:512]
+	}
+	return http.DetectContentType(data)
+}
+
+// Is multipart reports whether a Content-Type header denotes a multipart/form-data body
+func isMultipart(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// Sanitize filename reduces a client-supplied filename to a safe base name,
+// returning "" if nothing usable remains
+func sanitizeFilename(name string) string {
+	// Browsers on Windows may send full paths with backslashes
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// Content disposition builds an attachment Content-Disposition header value. The quoted
+// filename is an ASCII-only fallback; non-ASCII names are also sent RFC 5987 encoded.
+func contentDisposition(name string) string {
+	var fallback strings.Builder
+	needsEncoding := false
+	for _, r := range name {
+		switch {
+		case r > 0x7e:
+			fallback.WriteByte('_')
+			needsEncoding = true
+		case r < 0x20 || r == 0x7f:
+			// Control characters could inject headers; drop them
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	
+	value := fmt.Sprintf("attachment; filename=\"%s\"", fallback.String())
+	if needsEncoding {
+		value += "; filename*=UTF-8''" + encodeRFC5987(name)
+	}
+	return value
+}
+
+// Encode RFC 5987 percent-encodes every byte outside the RFC 5987 attr-char set
+func encodeRFC5987(value string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// Generate ETag builds a strong entity tag from the file's size and modification time
+func generateETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+// fingerprintPattern matches file names carrying a content hash, such as
+// app.3f9a2b7c.js or app-3f9a2b7c.css
+var fingerprintPattern = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^.]+$`)
+
+// Static cache control returns the Cache-Control value for a file served by name.
+// With ImmutableAssets set, a fingerprinted name may be cached for a year without
+// revalidating, since new content would get a new name; other files get
+// StaticCacheControl.
+func (s *Server) staticCacheControl(name string) string {
+	if s.config.ImmutableAssets && fingerprintPattern.MatchString(name) {
+		return "public, max-age=31536000, immutable"
+	}
+	return s.config.StaticCacheControl
+}
+
+// ETag matches reports whether an If-None-Match header value matches the given ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		// If-None-Match uses weak comparison
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Not modified evaluates the conditional request headers against the current file state.
+// If-None-Match takes precedence over If-Modified-Since when both are present.
+func notModified(headers map[string]string, etag string, modTime time.Time) bool {
+	if ifNoneMatch, ok := headers["If-None-Match"]; ok {
+		return etagMatches(ifNoneMatch, etag)
+	}
+	if ifModifiedSince, ok := headers["If-Modified-Since"]; ok {
+		since, err := parseHTTPTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision
+		return !modTime.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// Precondition failed evaluates If-Match and If-None-Match for a write to filePath.
+// If-Match requires the file to exist with a matching ETag, and If-None-Match
+// fails when the file exists and matches, so "If-None-Match: *" means create-only.
+func preconditionFailed(headers map[string]string, filePath string) bool {
+	etag := ""
+	info, err := os.Stat(filePath)
+	exists := err == nil && !info.IsDir()
+	if exists {
+		etag = generateETag(info)
+	}
+	
+	if ifMatch, ok := headers["If-Match"]; ok {
+		if !exists || !strongETagMatches(ifMatch, etag) {
+			return true
+		}
+	}
+	if ifNoneMatch, ok := headers["If-None-Match"]; ok && exists && etagMatches(ifNoneMatch, etag) {
+		return true
+	}
+	return false
+}
+
+// Strong ETag matches reports whether an If-Match header value matches the given ETag.
+// If-Match uses strong comparison, so weak validators never match.
+func strongETagMatches(ifMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || (candidate == etag && !strings.HasPrefix(candidate, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse HTTP time parses a date in any of the three formats allowed by HTTP/1.1
+func parseHTTPTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{httpTimeFormat, time.RFC1123, time.RFC850, time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// streamGzipThreshold is the body size above which sendResponse streams compressed
+// output with chunked encoding; smaller bodies are compressed in memory so they
+// can be sent with a Content-Length
+const streamGzipThreshold = 64 * 1024
+
+// bufferPool recycles the buffers used to build response headers and compressed bodies
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// gzipPool recycles gzip writers, which are expensive to allocate
+var gzipPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// Get buffer takes an empty buffer from the pool
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Write response head writes the status line and common headers shared by all responses.
+// The caller appends any framing headers and the terminating blank line.
+func writeResponseHead(
+	buf *bytes.Buffer,
+	proto string,
 	statusCode int,
 	statusText string,
 	contentType string,
-	body []byte,
-	headers map[string]string,
-	supportsGzip bool,
+	headers Header,
 	closeConnection bool,
 ) {
-	responseHeaders := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusText)
+	buf.WriteString(proto)
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.Itoa(statusCode))
+	buf.WriteByte(' ')
+	buf.WriteString(statusText)
+	buf.WriteString("\r\n")
 	
 	if contentType != "" {
-		responseHeaders += fmt.Sprintf("Content-Type: %s\r\n", contentType)
+		writeHeader(buf, "Content-Type", contentType)
 	}
 	
-	// Add Connection: close header if needed
+	// Say whether the connection stays open. HTTP/1.1 connections persist by default,
+	// but saying so helps proxies and HTTP/1.0 clients, which need the confirmation.
+	// Interim responses leave it to the final one.
 	if closeConnection {
-		responseHeaders += "Connection: close\r\n"
+		writeHeader(buf, "Connection", "close")
+	} else if statusCode >= 200 {
+		writeHeader(buf, "Connection", "keep-alive")
 	}
 	
-	// Add any additional headers
-	for key, value := range headers {
-		responseHeaders += fmt.Sprintf("%s: %s\r\n", key, value)
+	// Add any additional headers, one line per value of a repeated header. A final
+	// response's Connection header has been written already, and Keep-Alive only
+	// belongs on a final response that leaves the connection open.
+	for key, values := range headers {
+		if key == "Connection" && (closeConnection || statusCode >= 200) {
+			continue
+		}
+		if key == "Keep-Alive" && (closeConnection || statusCode < 200) {
+			continue
+		}
+		for _, value := range values {
+			writeHeader(buf, key, value)
+		}
+	}
+}
+
+// Write header writes a single "Key: value" header line
+func writeHeader(buf *bytes.Buffer, key string, value string) {
+	buf.WriteString(key)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteString("\r\n")
+}
+
+// Send response sends an HTTP response
+func sendResponse(
+	conn net.Conn,
+	statusCode int,
+	statusText string,
+	contentType string,
+	body []byte,
+	headers Header,
+	supportsGzip bool,
+	closeConnection bool,
+) {
+	// Large bodies are compressed straight onto the connection instead of into
+	// a second buffer
+	if supportsGzip && len(body) > streamGzipThreshold && responseProto(conn) != "HTTP/1.0" {
+		sendStream(conn, statusCode, statusText, contentType, bytes.NewReader(body), int64(len(body)), headers, true, closeConnection)
+		return
 	}
 	
+	recordStatus(conn, statusCode)
+	head := getBuffer()
+	defer bufferPool.Put(head)
+	writeResponseHead(head, responseProto(conn), statusCode, statusText, contentType, headers, closeConnection)
+	
 	// Gzip compression
 	if supportsGzip && len(body) > 0 {
-		var compressed bytes.Buffer
-		gz := gzip.NewWriter(&compressed)
+		compressed := getBuffer()
+		defer bufferPool.Put(compressed)
+		gz := gzipPool.Get().(*gzip.Writer)
+		gz.Reset(compressed)
 		gz.Write(body)
 		gz.Close()
+		gzipPool.Put(gz)
 		body = compressed.Bytes()
-		responseHeaders += "Content-Encoding: gzip\r\n"
+		writeHeader(head, "Content-Encoding", "gzip")
 	}
 	
-	responseHeaders += fmt.Sprintf("Content-Length: %d\r\n", len(body))
-	responseHeaders += "\r\n"
+	// 1xx, 204 and 304 responses never carry a body
+	if statusCode >= 200 && statusCode != 204 && statusCode != 304 {
+		writeHeader(head, "Content-Length", strconv.Itoa(len(body)))
+	}
+	head.WriteString("\r\n")
 	
-	conn.Write([]byte(responseHeaders))
+	conn.Write(head.Bytes())
 	if len(body) > 0 {
 		conn.Write(body)
 	}
 }
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
+// Send stream sends an HTTP response whose body is copied from a reader of known size.
+// Compressed bodies have no length up front, so they are sent with chunked encoding.
+// A negative size means the length isn't known either; for HTTP/1.0 clients such a
+// body ends when the connection closes, so the caller must close it afterwards.
+func sendStream(
+	conn net.Conn,
+	statusCode int,
+	statusText string,
+	contentType string,
+	body io.Reader,
+	size int64,
+	headers Header,
+	supportsGzip bool,
+	closeConnection bool,
+) error {
+	recordStatus(conn, statusCode)
+	head := getBuffer()
+	defer bufferPool.Put(head)
+	proto := responseProto(conn)
+	writeResponseHead(head, proto, statusCode, statusText, contentType, headers, closeConnection)
 	
-	config := Config{
-		Port:      "8080",
-		Directory: ".",
+	// HTTP/1.0 clients don't understand chunked encoding, so send them the body as is
+	if (!supportsGzip && size >= 0) || size == 0 || proto == "HTTP/1.0" {
+		if size >= 0 {
+			writeHeader(head, "Content-Length", strconv.FormatInt(size, 10))
+		}
+		head.WriteString("\r\n")
+		if _, err := conn.Write(head.Bytes()); err != nil {
+			return err
+		}
+		return copyBody(conn, body, size)
 	}
 	
-	// Process command line arguments
-	for i := 1; i < len(os.Args); i++ {
-		if os.Args[i] == "--directory" && i+1 < len(os.Args) {
-			config.Directory = os.Args[i+1]
-			i++
-		} else if os.Args[i] == "--port" && i+1 < len(os.Args) {
-			config.Port = os.Args[i+1]
-			i++
+	if supportsGzip {
+		writeHeader(head, "Content-Encoding", "gzip")
+	}
+	writeHeader(head, "Transfer-Encoding", "chunked")
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return err
+	}
+	
+	chunked := httputil.NewChunkedWriter(conn)
+	if supportsGzip {
+		gz := gzipPool.Get().(*gzip.Writer)
+		defer gzipPool.Put(gz)
+		gz.Reset(chunked)
+		if err := copyBody(gz, body, size); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
 		}
+	} else if err := copyBody(chunked, body, size); err != nil {
+		return err
+	}
+	if err := chunked.Close(); err != nil {
+		return err
+	}
+	// The chunked writer leaves the final CRLF after the (empty) trailer to us
+	_, err := conn.Write([]byte("\r\n"))
+	return err
+}
+
+// Copy body copies size bytes from src to dst, or all of src when size is negative
+func copyBody(dst io.Writer, src io.Reader, size int64) error {
+	var err error
+	if size < 0 {
+		_, err = io.Copy(dst, src)
+	} else {
+		_, err = io.CopyN(dst, src, size)
+	}
+	return err
+}
+
+func main() {
+	// Settings are layered: environment variables, then the config file, then flags
+	config, err := LoadEnv(DefaultConfig())
+	if err != nil {
+		log.Fatalf("Environment error: %v", err)
+	}
+	
+	config, err = parseFlags(config, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
 	
 	server := NewServer(config)
 	
 	// Handle graceful shutdown
+	shutdownDone := make(chan struct{})
 	go func() {
 		c := make(chan os.Signal, 1)
 		// os.Interrupt is equivalent to SIGINT (Ctrl+C)
-		// You'll need to import "os/signal" for this
-		// signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
 		log.Println("Shutting down server...")
-		server.Stop()
-		os.Exit(0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown incomplete: %v", err)
+		}
+		close(shutdownDone)
 	}()
 	
 	if err := server.Start(); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
+	<-shutdownDone
+	log.Println("Server stopped")
 }
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// New test server returns a server over a temporary directory with config's other settings
+func newTestServer(t testing.TB, config Config) *Server {
+	t.Helper()
+	config.Directory = t.TempDir()
+	return NewServer(config)
+}
+
+// recordConn is a connection that records what is written to it and how many writes it took
+type recordConn struct {
+	net.Conn
+	buf    bytes.Buffer
+	writes int
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.buf.Write(b)
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+// Response parses the response written to c
+func (c *recordConn) response(t *testing.T) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.buf.Bytes())), nil)
+	if err != nil {
+		t.Fatalf("parsing response: %v\n%s", err, c.buf.String())
+	}
+	return resp
+}
+
+// Start test server starts a server with config on a free local port and returns its address
+func startTestServer(t testing.TB, config Config) (*Server, string) {
+	t.Helper()
+	config.BindAddress = "127.0.0.1"
+	config.Port = "0"
+	s := newTestServer(t, config)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+	
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.ready.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return s, s.listener.Addr().String()
+}
+
+// Round trip sends a raw request to s over an in-memory connection and reads its response
+func roundTrip(t *testing.T, s *Server, request string) *http.Response {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go s.handleConnection(server)
+	
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, request); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Response body returns the whole body of resp
+func responseBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(body)
+}
+
+// logBuffer collects log output that connection goroutines may still be writing
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Capture log sends the log, JSON access lines included, to a buffer until the test ends
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	previous, previousAccess := log.Writer(), accessLogger.Writer()
+	log.SetOutput(buf)
+	accessLogger.SetOutput(buf)
+	t.Cleanup(func() {
+		log.SetOutput(previous)
+		accessLogger.SetOutput(previousAccess)
+	})
+	return buf
+}
+
+func TestRecoverPanic(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 5 * time.Second} {
+		logs := captureLog(t)
+		config := DefaultConfig()
+		config.RequestTimeout = Duration(timeout)
+		s := newTestServer(t, config)
+		
+		router := NewRouter()
+		if timeout > 0 {
+			// Handlers run on their own goroutine under the timeout middleware
+			router.Use(s.timeoutMiddleware)
+		}
+		router.Handle("GET", "/boom", func(conn net.Conn, req *Request) {
+			panic("boom")
+		})
+		router.Handle("GET", "/partial", func(conn net.Conn, req *Request) {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nhalf")
+			panic("boom")
+		})
+		router.Handle("GET", "/ok", func(conn net.Conn, req *Request) {
+			sendResponse(conn, 200, "OK", "text/plain", []byte("ok"), req.ResponseHeaders, false, req.Close)
+		})
+		s.router = router
+		
+		resp := roundTrip(t, s, "GET /boom HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if resp.StatusCode != 500 {
+			t.Errorf("timeout %s: status = %d, want 500", timeout, resp.StatusCode)
+		}
+		if !resp.Close {
+			t.Errorf("timeout %s: connection left open after a panic", timeout)
+		}
+		if !strings.Contains(responseBody(t, resp), "Internal Server Error") {
+			t.Errorf("timeout %s: body doesn't describe the error", timeout)
+		}
+		if !strings.Contains(logs.String(), "panic serving GET /boom: boom") || !strings.Contains(logs.String(), "goroutine ") {
+			t.Errorf("timeout %s: panic not logged with its stack:\n%s", timeout, logs)
+		}
+		
+		// Once the response has started, the connection is cut rather than sent a 500
+		resp = roundTrip(t, s, "GET /partial HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if body, err := io.ReadAll(resp.Body); err == nil || string(body) != "half" {
+			t.Errorf("timeout %s: partial response body = %q, %v; want it cut short after half", timeout, body, err)
+		}
+		
+		// The server carries on with the next connection
+		if resp := roundTrip(t, s, "GET /ok HTTP/1.1\r\nHost: localhost\r\n\r\n"); resp.StatusCode != 200 {
+			t.Errorf("timeout %s: status after panic = %d, want 200", timeout, resp.StatusCode)
+		}
+	}
+}
+
+func TestKeepAliveAnnounced(t *testing.T) {
+	config := DefaultConfig()
+	config.IdleTimeout = Duration(30 * time.Second)
+	s := newTestServer(t, config)
+	
+	resp := roundTrip(t, s, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if got := resp.Header.Get("Keep-Alive"); got != "timeout=30" {
+		t.Errorf("Keep-Alive = %q, want timeout=30", got)
+	}
+	if got := resp.Header.Values("Connection"); len(got) != 1 || got[0] != "keep-alive" {
+		t.Errorf("Connection = %q, want a single keep-alive", got)
+	}
+	
+	// Closing responses, errors among them, leave the timeout out
+	for _, request := range []string{
+		"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+		"GET /missing HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+	} {
+		resp := roundTrip(t, s, request)
+		if got := resp.Header.Get("Keep-Alive"); got != "" {
+			t.Errorf("closing %d response has Keep-Alive %q", resp.StatusCode, got)
+		}
+		if !resp.Close {
+			t.Errorf("%d response doesn't close the connection", resp.StatusCode)
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	const limit = 2
+	config := DefaultConfig()
+	config.MaxConnections = limit
+	_, addr := startTestServer(t, config)
+	
+	// Hold every slot with a connection that stays open between requests
+	var held []net.Conn
+	for i := 0; i < limit; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dialing: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("connection %d: %v, %v", i+1, resp, err)
+		}
+		held = append(held, conn)
+	}
+	
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("reading the refusal: %v", err)
+	}
+	if resp.StatusCode != 503 {
+		t.Errorf("connection %d: status = %d, want 503", limit+1, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("connection %d: Retry-After = %q, want 1", limit+1, got)
+	}
+	if !resp.Close {
+		t.Errorf("connection %d left open after the refusal", limit+1)
+	}
+	
+	// Closing a held connection frees its slot for the next client
+	held[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dialing: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err == nil && resp.StatusCode == 200 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot never freed: %v, %v", resp, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkConnections compares a goroutine per connection with the worker pool
+// under a burst of short connections, each carrying a single request
+func BenchmarkConnections(b *testing.B) {
+	previous := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(previous) })
+	
+	for _, workers := range []int{0, 16} {
+		name := "goroutine-per-conn"
+		if workers > 0 {
+			name = "workers-" + strconv.Itoa(workers)
+		}
+		b.Run(name, func(b *testing.B) {
+			config := DefaultConfig()
+			config.Workers = workers
+			_, addr := startTestServer(b, config)
+			
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.WriteString(conn, "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+					response, err := io.ReadAll(conn)
+					conn.Close()
+					if err != nil || !bytes.HasPrefix(response, []byte("HTTP/1.1 200 ")) {
+						b.Errorf("unexpected response %q: %v", response, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Baseline send response is sendResponse as it was before headers were built in a
+// pooled buffer, copied unchanged apart from its name, as a reference for the output
+func baselineSendResponse(
+	conn net.Conn,
+	statusCode int,
+	statusText string,
+	contentType string,
+	body []byte,
+	headers map[string]string,
+	supportsGzip bool,
+	closeConnection bool,
+) {
+	responseHeaders := fmt.Sprintf("HTTP/1.1 %d %s\r\n", statusCode, statusText)
+	
+	if contentType != "" {
+		responseHeaders += fmt.Sprintf("Content-Type: %s\r\n", contentType)
+	}
+	
+	// Add Connection: close header if needed
+	if closeConnection {
+		responseHeaders += "Connection: close\r\n"
+	}
+	
+	// Add any additional headers
+	for key, value := range headers {
+		responseHeaders += fmt.Sprintf("%s: %s\r\n", key, value)
+	}
+	
+	// Gzip compression
+	if supportsGzip && len(body) > 0 {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(body)
+		gz.Close()
+		body = compressed.Bytes()
+		responseHeaders += "Content-Encoding: gzip\r\n"
+	}
+	
+	responseHeaders += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+	responseHeaders += "\r\n"
+	
+	conn.Write([]byte(responseHeaders))
+	if len(body) > 0 {
+		conn.Write(body)
+	}
+}
+
+func TestSendResponseMatchesBaseline(t *testing.T) {
+	// The baseline never announced keep-alive, so the cases close the connection,
+	// and each has at most one header so map order can't change the output
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20))
+	tests := []struct {
+		name        string
+		statusCode  int
+		statusText  string
+		contentType string
+		body        []byte
+		header      string
+		value       string
+		gzip        bool
+	}{
+		{"plain", 200, "OK", "text/plain", []byte("hello"), "", "", false},
+		{"header", 404, "Not Found", "application/json", []byte(`{"error":"missing"}`), "X-Request-ID", "abc", false},
+		{"no content type or body", 200, "OK", "", nil, "Set-Cookie", "a=1; Path=/", false},
+		{"gzip", 200, "OK", "text/plain", text, "Vary", "Accept-Encoding", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := Header{}
+			baselineHeaders := map[string]string{}
+			if tt.header != "" {
+				headers.Set(tt.header, tt.value)
+				baselineHeaders[tt.header] = tt.value
+			}
+			got, want := &recordConn{}, &recordConn{}
+			sendResponse(got, tt.statusCode, tt.statusText, tt.contentType, tt.body, headers, tt.gzip, true)
+			baselineSendResponse(want, tt.statusCode, tt.statusText, tt.contentType, tt.body, baselineHeaders, tt.gzip, true)
+			if !bytes.Equal(got.buf.Bytes(), want.buf.Bytes()) {
+				t.Errorf("response = %q, want %q", got.buf.String(), want.buf.String())
+			}
+		})
+	}
+}
+
+// benchmarkHeaders is a header set the size of a typical file response
+var benchmarkHeaders = Header{
+	"Set-Cookie":             {"session=0123456789abcdef0123456789abcdef; Path=/"},
+	"X-Request-ID":           {"0123456789abcdef0123456789abcdef"},
+	"X-Content-Type-Options": {"nosniff"},
+	"ETag":                   {`"5f3a1c-1a2b"`},
+	"Last-Modified":          {"Fri, 16 Oct 2026 12:00:00 GMT"},
+	"Cache-Control":          {"public, max-age=3600"},
+	"Accept-Ranges":          {"bytes"},
+	"Vary":                   {"Accept-Encoding"},
+	"Keep-Alive":             {"timeout=60"},
+}
+
+func BenchmarkWriteResponseHead(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer()
+		writeResponseHead(buf, "HTTP/1.1", 200, "OK", "text/html; charset=utf-8", benchmarkHeaders, false)
+		bufferPool.Put(buf)
+	}
+}
+
+func BenchmarkBaselineSendResponse(b *testing.B) {
+	// The baseline took one value per header
+	headers := make(map[string]string, len(benchmarkHeaders))
+	for key, values := range benchmarkHeaders {
+		headers[key] = values[0]
+	}
+	body := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 40)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		baselineSendResponse(discardConn{}, 200, "OK", "text/plain", body, headers, false, false)
+	}
+}
+
+// discardConn is a connection that throws away whatever is written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkSendResponse(b *testing.B) {
+	body := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 40)
+	for _, gzip := range []bool{false, true} {
+		name := "identity"
+		if gzip {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				sendResponse(discardConn{}, 200, "OK", "text/plain", body, benchmarkHeaders, gzip, false)
+			}
+		})
+	}
+}
+
+func TestFilesRootPost(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	os.MkdirAll(filepath.Join(s.config.Directory, "files"), 0755)
+	
+	resp := roundTrip(t, s, "POST /files HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 4\r\nConnection: close\r\n\r\ndata")
+	if resp.StatusCode != 415 {
+		t.Errorf("non-multipart POST: status %d, want 415", resp.StatusCode)
+	}
+	
+	form := "--b\r\nContent-Disposition: form-data; name=\"file\"; filename=\"a.txt\"\r\n\r\nhello\r\n--b--\r\n"
+	resp = roundTrip(t, s, "POST /files HTTP/1.1\r\nHost: localhost\r\nContent-Type: multipart/form-data; boundary=b\r\nContent-Length: "+
+		strconv.Itoa(len(form))+"\r\nConnection: close\r\n\r\n"+form)
+	if resp.StatusCode != 201 {
+		t.Errorf("multipart POST: status %d, want 201", resp.StatusCode)
+	}
+}
+
+func TestResumableUploadCleanup(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{MaxUploadSize: 10})
+	filesDir := filepath.Join(s.config.Directory, "files")
+	os.MkdirAll(filesDir, 0755)
+	partPath := uploadPartPath(filepath.Join(filesDir, "big.bin"))
+	
+	// A claimed total past the limit is refused before anything is written
+	resp := roundTrip(t, s, "PUT /files/big.bin HTTP/1.1\r\nHost: localhost\r\nContent-Range: bytes 0-0/1099511627776\r\nContent-Length: 1\r\nConnection: close\r\n\r\nx")
+	if resp.StatusCode != 413 {
+		t.Errorf("total over limit: status %d, want 413", resp.StatusCode)
+	}
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("total over limit left a partial file: %v", err)
+	}
+	
+	resp = roundTrip(t, s, "PUT /files/big.bin HTTP/1.1\r\nHost: localhost\r\nContent-Range: bytes 0-1/4\r\nContent-Length: 2\r\nConnection: close\r\n\r\nab")
+	if resp.StatusCode != 308 {
+		t.Fatalf("first piece: status %d, want 308", resp.StatusCode)
+	}
+	if info, err := os.Stat(partPath); err != nil || info.Size() != 2 {
+		t.Fatalf("partial file after first piece: %v, %v", info, err)
+	}
+	
+	// A recent upload survives expiry, an idle one is dropped with its partial file
+	s.expireUploads(time.Hour)
+	if _, err := os.Stat(partPath); err != nil {
+		t.Errorf("recent upload expired: %v", err)
+	}
+	s.expireUploads(0)
+	if _, err := os.Stat(partPath); !os.IsNotExist(err) {
+		t.Errorf("idle upload kept its partial file: %v", err)
+	}
+	if len(s.uploads) != 0 {
+		t.Errorf("idle upload still tracked: %d uploads", len(s.uploads))
+	}
+	
+	// Partial files from a previous run are removed, everything else is kept
+	os.MkdirAll(filepath.Join(filesDir, "sub"), 0755)
+	orphan := filepath.Join(filesDir, "sub", ".old.txt.upload")
+	kept := []string{filepath.Join(filesDir, "old.txt.upload"), filepath.Join(filesDir, ".hidden")}
+	for _, path := range append(kept, orphan) {
+		os.WriteFile(path, []byte("x"), 0644)
+	}
+	removeOrphanedUploads(filesDir)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphaned partial file kept: %v", err)
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestAPIAnythingHeaders(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	
+	resp := roundTrip(t, s, "GET /api/anything HTTP/1.1\r\nHost: localhost\r\nX-Test: one\r\nx-test: two, three\r\nConnection: close\r\n\r\n")
+	var anything AnythingResponse
+	if err := json.Unmarshal([]byte(responseBody(t, resp)), &anything); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	// Each line is its own value, even one that holds a comma itself
+	want := []string{"one", "two, three"}
+	if got := anything.Headers["X-Test"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("X-Test = %q, want %q", got, want)
+	}
+	if got := anything.Headers["Host"]; !reflect.DeepEqual(got, []string{"localhost"}) {
+		t.Errorf("Host = %q, want [localhost]", got)
+	}
+}
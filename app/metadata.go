@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MetadataStore remembers the content type each file was uploaded with, keyed
+// by the file's slash-separated path relative to the files directory. It is
+// persisted as JSON so types survive restarts.
+type MetadataStore struct {
+	path  string
+	types map[string]string
+	mutex sync.RWMutex
+}
+
+// NewMetadataStore loads the store kept at path, starting empty if it doesn't exist yet
+func NewMetadataStore(path string) *MetadataStore {
+	store := &MetadataStore{path: path, types: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading metadata store %s: %v", path, err)
+		}
+		return store
+	}
+	if err := json.Unmarshal(data, &store.types); err != nil {
+		log.Printf("Error parsing metadata store %s: %v", path, err)
+	}
+	return store
+}
+
+// ContentType returns the stored content type for a file, if any
+func (m *MetadataStore) ContentType(key string) (string, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	contentType, ok := m.types[key]
+	return contentType, ok
+}
+
+// SetContentType records a file's content type; an empty type forgets it
+func (m *MetadataStore) SetContentType(key string, contentType string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if contentType == "" {
+		if _, ok := m.types[key]; !ok {
+			return nil
+		}
+		delete(m.types, key)
+	} else {
+		m.types[key] = contentType
+	}
+	return m.save()
+}
+
+// Remove forgets a file, or a directory and everything under it. The empty key
+// stands for the files directory itself, or a path outside it, and removes nothing.
+func (m *MetadataStore) Remove(key string) error {
+	if key == "" {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	removed := false
+	for stored := range m.types {
+		if stored == key || strings.HasPrefix(stored, key+"/") {
+			delete(m.types, stored)
+			removed = true
+		}
+	}
+	if !removed {
+		return nil
+	}
+	return m.save()
+}
+
+// Save writes the store to disk; the caller holds the lock
+func (m *MetadataStore) save() error {
+	data, err := json.Marshal(m.types)
+	if err != nil {
+		return err
+	}
+	_, err = writeFileAtomic(m.path, bytes.NewReader(data), false)
+	return err
+}
+
+// Upload content type returns the normalized type a client declared for an upload,
+// from the content_type query parameter or the Content-Type header. curl and
+// browsers send form encoding by default, so that type is not treated as a declaration.
+func uploadContentType(queryType string, headerType string) string {
+	declared := queryType
+	if declared == "" {
+		declared = headerType
+	}
+	mediaType, params, err := mime.ParseMediaType(declared)
+	if err != nil || mediaType == "application/x-www-form-urlencoded" {
+		return ""
+	}
+	// Re-encoding drops anything that isn't a well-formed media type
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// Record content type stores the declared type of an uploaded file, or forgets
+// any previous one when none was declared
+func (s *Server) recordContentType(filePath string, contentType string) {
+	if err := s.metadata.SetContentType(s.metadataKey(filePath), contentType); err != nil {
+		log.Printf("Error saving metadata for %s: %v", filePath, err)
+	}
+}
+
+// Forget metadata drops what the store knows about a deleted file or directory
+func (s *Server) forgetMetadata(filePath string) {
+	if err := s.metadata.Remove(s.metadataKey(filePath)); err != nil {
+		log.Printf("Error saving metadata for %s: %v", filePath, err)
+	}
+}
+
+// Content type for returns the type a file was uploaded with, or one detected
+// from its name and the first bytes of its content
+func (s *Server) contentTypeFor(filePath string, head []byte) string {
+	if contentType, ok := s.metadata.ContentType(s.metadataKey(filePath)); ok {
+		return contentType
+	}
+	return detectContentType(filePath, head)
+}
+
+// Metadata key returns the metadata store key for a path inside the files directory
+func (s *Server) metadataKey(filePath string) string {
+	rel, err := filepath.Rel(filepath.Join(s.config.Directory, "files"), filePath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataStoreRemove(t *testing.T) {
+	m := NewMetadataStore(filepath.Join(t.TempDir(), "metadata.json"))
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir2/d.txt"} {
+		if err := m.SetContentType(key, "text/plain"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	// The empty key is the files root, which must never match everything
+	if err := m.Remove(""); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.types) != 4 {
+		t.Fatalf("removing the empty key left %d of 4 entries", len(m.types))
+	}
+	
+	if err := m.Remove("dir"); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"a.txt": true, "dir/b.txt": false, "dir/sub/c.txt": false, "dir2/d.txt": true} {
+		if _, ok := m.ContentType(key); ok != want {
+			t.Errorf("%s stored = %v after removing dir, want %v", key, ok, want)
+		}
+	}
+	
+	// The removal is persisted
+	reloaded := NewMetadataStore(m.path)
+	if len(reloaded.types) != 2 {
+		t.Errorf("reloaded store has %d entries, want 2", len(reloaded.types))
+	}
+}
+
+func TestForgetMetadataOfFilesRoot(t *testing.T) {
+	s := newTestServer(t, Config{})
+	filesDir := filepath.Join(s.config.Directory, "files")
+	s.recordContentType(filepath.Join(filesDir, "a.txt"), "text/csv")
+	
+	s.forgetMetadata(filesDir)
+	if contentType, ok := s.metadata.ContentType("a.txt"); !ok || contentType != "text/csv" {
+		t.Errorf("forgetting the files root dropped a.txt's type (%q, %v)", contentType, ok)
+	}
+}
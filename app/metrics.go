@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request duration histogram
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics holds the server's counters, updated atomically from connection goroutines
+type Metrics struct {
+	requestsTotal     atomic.Int64
+	responsesByClass  [5]atomic.Int64
+	bytesWritten      atomic.Int64
+	activeConnections atomic.Int64
+	durationBuckets   []atomic.Int64
+	durationCount     atomic.Int64
+	durationSumNanos  atomic.Int64
+}
+
+// NewMetrics creates an empty metrics set
+func NewMetrics() *Metrics {
+	return &Metrics{
+		durationBuckets: make([]atomic.Int64, len(durationBuckets)),
+	}
+}
+
+// ObserveRequest records a completed request
+func (m *Metrics) ObserveRequest(status int, bytesWritten int64, duration time.Duration) {
+	m.requestsTotal.Add(1)
+	if class := status / 100; class >= 1 && class <= 5 {
+		m.responsesByClass[class-1].Add(1)
+	}
+	m.bytesWritten.Add(bytesWritten)
+	
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.durationBuckets[i].Add(1)
+		}
+	}
+	m.durationCount.Add(1)
+	m.durationSumNanos.Add(int64(duration))
+}
+
+// Write prometheus renders the metrics in the Prometheus text exposition format
+func (m *Metrics) writePrometheus(buf *bytes.Buffer) {
+	buf.WriteString("# HELP http_requests_total Total number of HTTP requests handled.\n")
+	buf.WriteString("# TYPE http_requests_total counter\n")
+	fmt.Fprintf(buf, "http_requests_total %d\n", m.requestsTotal.Load())
+	
+	buf.WriteString("# HELP http_responses_total Total number of HTTP responses by status class.\n")
+	buf.WriteString("# TYPE http_responses_total counter\n")
+	for i := range m.responsesByClass {
+		fmt.Fprintf(buf, "http_responses_total{code=\"%dxx\"} %d\n", i+1, m.responsesByClass[i].Load())
+	}
+	
+	buf.WriteString("# HELP http_response_bytes_total Total number of bytes written in HTTP responses.\n")
+	buf.WriteString("# TYPE http_response_bytes_total counter\n")
+	fmt.Fprintf(buf, "http_response_bytes_total %d\n", m.bytesWritten.Load())
+	
+	buf.WriteString("# HELP http_active_connections Number of currently open client connections.\n")
+	buf.WriteString("# TYPE http_active_connections gauge\n")
+	fmt.Fprintf(buf, "http_active_connections %d\n", m.activeConnections.Load())
+	
+	buf.WriteString("# HELP http_request_duration_seconds Time spent handling HTTP requests.\n")
+	buf.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(buf, "http_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.durationBuckets[i].Load())
+	}
+	count := m.durationCount.Load()
+	fmt.Fprintf(buf, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(buf, "http_request_duration_seconds_sum %g\n", time.Duration(m.durationSumNanos.Load()).Seconds())
+	fmt.Fprintf(buf, "http_request_duration_seconds_count %d\n", count)
+}
+
+// Handle metrics serves the metrics endpoint. Scrapes are not counted themselves.
+func (s *Server) handleMetrics(conn net.Conn, headers Header, closeConn bool) {
+	var buf bytes.Buffer
+	s.metrics.writePrometheus(&buf)
+	if s.fileCache != nil {
+		s.fileCache.writePrometheus(&buf)
+	}
+	sendResponse(conn, 200, "OK", "text/plain; version=0.0.4", buf.Bytes(), headers, false, closeConn)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"mime"
+	"net"
+	"net/textproto"
+	"strings"
+)
+
+// Middleware wraps a handler with additional behavior. A middleware can act before
+// and after calling next, or respond itself without calling it.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Use adds middleware around every handler the router returns, including the
+// not found and method not allowed responses. Middleware runs in the order it
+// was added, so the first one added is the outermost.
+func (r *Router) Use(mw Middleware) {
+	r.middleware = append(r.middleware, mw)
+}
+
+// Wrap applies the router's middleware to h
+func (r *Router) wrap(h HandlerFunc) HandlerFunc {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		h = r.middleware[i](h)
+	}
+	return h
+}
+
+// Security headers adds the configured hardening headers to every response, and
+// HSTS when serving HTTPS unless the configuration sets it
+func (s *Server) securityHeaders(next HandlerFunc) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		if s.config.TLSEnabled() {
+			req.ResponseHeaders.Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		for name, value := range s.config.SecurityHeaders {
+			if value == "" {
+				req.ResponseHeaders.Del(name)
+				continue
+			}
+			req.ResponseHeaders.Set(name, value)
+		}
+		next(conn, req)
+	}
+}
+
+// With HTML headers adds the configured HTML-only security headers to the headers of
+// a response with the given content type, when that is HTML. Headers the response
+// already sets are left alone, and an empty value adds nothing.
+func (s *Server) withHTMLHeaders(contentType string, headers Header) Header {
+	if len(s.config.HTMLSecurityHeaders) == 0 {
+		return headers
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/html" {
+		return headers
+	}
+	
+	merged := headers.Clone()
+	set := make(map[string]bool, len(headers))
+	for name := range headers {
+		set[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	for name, value := range s.config.HTMLSecurityHeaders {
+		if value != "" && !set[textproto.CanonicalMIMEHeaderKey(name)] {
+			merged.Set(name, value)
+		}
+	}
+	return merged
+}
+
+// CORS middleware applies the CORS policy to API routes and answers preflights
+// before authentication, since browsers send them without credentials
+func (s *Server) corsMiddleware(next HandlerFunc) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		if strings.HasPrefix(req.Path, "/api/") && s.config.CORS.applyCORS(req.Method, req.Headers, req.ResponseHeaders) {
+			sendResponse(conn, 204, "No Content", "", nil, req.ResponseHeaders, false, req.Close)
+			return
+		}
+		next(conn, req)
+	}
+}
+
+// Auth middleware protects API routes when tokens are configured
+func (s *Server) authMiddleware(next HandlerFunc) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		if strings.HasPrefix(req.Path, "/api/") && !s.authorized(req.Headers["Authorization"]) {
+			req.ResponseHeaders.Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeError(conn, 401, "Unauthorized", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		next(conn, req)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithHTMLHeaders(t *testing.T) {
+	config := DefaultConfig()
+	config.HTMLSecurityHeaders = map[string]string{"X-Frame-Options": "DENY", "Referrer-Policy": ""}
+	s := newTestServer(t, config)
+	
+	headers := s.withHTMLHeaders("text/html; charset=utf-8", Header{"ETag": {`"1"`}})
+	if got := headers.Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("HTML response X-Frame-Options = %q, want DENY", got)
+	}
+	if _, ok := headers["Referrer-Policy"]; ok {
+		t.Error("a header with an empty value was added")
+	}
+	
+	original := Header{"x-frame-options": {"SAMEORIGIN"}}
+	headers = s.withHTMLHeaders("text/html", original)
+	if got := headers.Get("x-frame-options"); got != "SAMEORIGIN" || headers.Get("X-Frame-Options") != "" {
+		t.Errorf("a header the response sets was overridden: %v", headers)
+	}
+	
+	plain := Header{}
+	if headers := s.withHTMLHeaders("text/plain", plain); len(headers) != 0 {
+		t.Errorf("plain text response got %v", headers)
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{APITokens: []string{"secret", "other"}})
+	tests := []struct {
+		name          string
+		path          string
+		authorization string
+		status        int
+	}{
+		{"valid token", "/api/status", "Bearer secret", 200},
+		{"second token", "/api/status", "Bearer other", 200},
+		{"wrong token", "/api/status", "Bearer nope", 401},
+		{"missing header", "/api/status", "", 401},
+		{"other scheme", "/api/status", "Basic c2VjcmV0", 401},
+		{"bare token", "/api/status", "secret", 401},
+		{"probe", "/healthz", "", 200},
+		{"outside the API", "/echo/abc", "", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := "GET " + tt.path + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n"
+			if tt.authorization != "" {
+				request += "Authorization: " + tt.authorization + "\r\n"
+			}
+			resp := roundTrip(t, s, request+"\r\n")
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			challenge := resp.Header.Get("WWW-Authenticate")
+			if tt.status == 401 && !strings.HasPrefix(challenge, "Bearer") {
+				t.Errorf("WWW-Authenticate = %q, want a Bearer challenge", challenge)
+			}
+			if tt.status == 200 && challenge != "" {
+				t.Errorf("authorized response has WWW-Authenticate %q", challenge)
+			}
+		})
+	}
+}
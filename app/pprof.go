@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Start pprof serves the net/http/pprof handlers on a separate debug listener,
+// keeping profiling endpoints off the public port. The listener is bound before
+// returning, so the server's Addr holds the port it actually got.
+func (s *Server) startPprof() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	
+	listener, err := net.Listen("tcp", s.config.PprofAddress)
+	if err != nil {
+		log.Printf("pprof server error: %v", err)
+		return
+	}
+	s.debugServer = &http.Server{Addr: listener.Addr().String(), Handler: mux}
+	go func() {
+		log.Printf("Serving pprof on http://%s/debug/pprof/", s.debugServer.Addr)
+		if err := s.debugServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("pprof server error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	captureLog(t)
+	get := func(url string) int {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	
+	t.Run("enabled", func(t *testing.T) {
+		s, addr := startTestServer(t, Config{EnablePprof: true, PprofAddress: "127.0.0.1:0"})
+		if s.debugServer == nil {
+			t.Fatal("debug server not started")
+		}
+		if status := get("http://" + s.debugServer.Addr + "/debug/pprof/cmdline"); status != 200 {
+			t.Errorf("debug listener: status %d, want 200", status)
+		}
+		// The public port never serves the profiling endpoints
+		if status := get("http://" + addr + "/debug/pprof/cmdline"); status != 404 {
+			t.Errorf("public port: status %d, want 404", status)
+		}
+	})
+	
+	t.Run("disabled", func(t *testing.T) {
+		s, addr := startTestServer(t, Config{PprofAddress: "127.0.0.1:0"})
+		if s.debugServer != nil {
+			t.Fatal("debug server started without EnablePprof")
+		}
+		if status := get("http://" + addr + "/debug/pprof/cmdline"); status != 404 {
+			t.Errorf("status %d, want 404", status)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyDialTimeout bounds how long connecting to an upstream may take
+const proxyDialTimeout = 10 * time.Second
+
+// hopHeaders describe a single connection rather than the message, so a proxy
+// must not forward them (RFC 9110 section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Parse upstream checks that an upstream URL is an absolute http URL
+func parseUpstream(upstreamURL string) (*url.URL, error) {
+	upstream, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "http" || upstream.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an http:// URL with a host", upstreamURL)
+	}
+	return upstream, nil
+}
+
+// Proxy route forwards requests for paths under prefix to the upstream server.
+// The prefix is replaced by the upstream URL's path, so with the prefix /backend
+// and the upstream http://localhost:9000/api, /backend/users is fetched from
+// http://localhost:9000/api/users.
+func (s *Server) ProxyRoute(prefix string, upstreamURL string) error {
+	upstream, err := parseUpstream(upstreamURL)
+	if err != nil {
+		return err
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		prefix = ""
+	}
+	
+	handler := s.proxyHandler(prefix, upstream)
+	if prefix != "" {
+		s.router.Handle("", prefix, handler)
+	}
+	s.router.Handle("", prefix+"/*", handler)
+	return nil
+}
+
+// Proxy handler sends each request on to the upstream over a fresh connection and
+// relays the response back as it arrives
+func (s *Server) proxyHandler(prefix string, upstream *url.URL) HandlerFunc {
+	basePath := strings.TrimSuffix(upstream.Path, "/")
+	host := upstream.Host
+	if upstream.Port() == "" {
+		host = net.JoinHostPort(upstream.Hostname(), "80")
+	}
+	
+	return func(conn net.Conn, req *Request) {
+		path := basePath + strings.TrimPrefix(req.Path, prefix)
+		if path == "" {
+			path = "/"
+		}
+		target := path
+		if len(req.Query) > 0 {
+			target += "?" + req.Query.Encode()
+		}
+		
+		dialer := net.Dialer{Timeout: proxyDialTimeout}
+		upstreamConn, err := dialer.DialContext(req.Context(), "tcp", host)
+		if err != nil {
+			log.Printf("request_id=%s proxy to %s failed: %v", requestIDFromContext(req.Context()), upstream.Host, err)
+			writeError(conn, 502, "Bad Gateway", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		defer upstreamConn.Close()
+		// Abandon the upstream if the client goes away or the request times out
+		stop := context.AfterFunc(req.Context(), func() { upstreamConn.Close() })
+		defer stop()
+		
+		if err := writeProxyRequest(upstreamConn, req, upstream.Host, target, remoteIP(conn)); err != nil {
+			log.Printf("request_id=%s proxy to %s failed: %v", requestIDFromContext(req.Context()), upstream.Host, err)
+			writeError(conn, 502, "Bad Gateway", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		
+		resp, err := http.ReadResponse(bufio.NewReader(upstreamConn), &http.Request{Method: req.Method})
+		if err != nil {
+			log.Printf("request_id=%s proxy to %s failed: %v", requestIDFromContext(req.Context()), upstream.Host, err)
+			writeError(conn, 502, "Bad Gateway", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		defer resp.Body.Close()
+		
+		// Upstream headers win over the ones prepared here, whatever their case, except
+		// for those that only concern the upstream connection
+		removeHopHeaders(resp.Header, strings.Join(resp.Header.Values("Connection"), ","))
+		headers := make(Header, len(req.ResponseHeaders)+len(resp.Header))
+		for key, values := range req.ResponseHeaders {
+			if _, ok := resp.Header[textproto.CanonicalMIMEHeaderKey(key)]; !ok {
+				headers[key] = values
+			}
+		}
+		// Each upstream value keeps a line of its own, as cookies must
+		for key, values := range resp.Header {
+			headers[key] = values
+		}
+		contentType := headers.Get("Content-Type")
+		headers.Del("Content-Type")
+		headers.Del("Content-Length")
+		statusText := strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
+		headers = s.withHTMLHeaders(contentType, headers)
+		
+		// The upstream's encoding is passed through untouched, so the body is never gzipped again
+		switch {
+		case resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 304:
+			sendResponse(conn, resp.StatusCode, statusText, contentType, nil, headers, false, req.Close)
+		case req.Method == "HEAD":
+			sendStream(conn, resp.StatusCode, statusText, contentType, resp.Body, 0, headers, false, req.Close)
+		default:
+			// A body of unknown length ends when the connection closes for HTTP/1.0 clients
+			closeConn := req.Close || resp.ContentLength < 0 && responseProto(conn) == "HTTP/1.0"
+			if err := sendStream(conn, resp.StatusCode, statusText, contentType, resp.Body, resp.ContentLength, headers, false, closeConn); err != nil {
+				// The response is already under way, so the client can only learn of the failure by the connection closing
+				conn.Close()
+			} else if closeConn && !req.Close {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// Write proxy request sends req to the upstream, addressed to host and target.
+// The client's address is appended to X-Forwarded-For, the request ID is passed on so
+// both servers log the same one, and the upstream is asked to close the connection so
+// each request gets its own.
+func writeProxyRequest(upstreamConn net.Conn, req *Request, host string, target string, clientIP string) error {
+	headers := make(map[string]string, len(req.Headers)+2)
+	for key, value := range req.Headers {
+		headers[key] = value
+	}
+	removeHopHeaders(headers, headers["Connection"])
+	delete(headers, "Host")
+	delete(headers, "Content-Length")
+	headers["X-Request-Id"] = requestIDFromContext(req.Context())
+	
+	if prior := headers["X-Forwarded-For"]; prior != "" {
+		headers["X-Forwarded-For"] = prior + ", " + clientIP
+	} else {
+		headers["X-Forwarded-For"] = clientIP
+	}
+	
+	buf := getBuffer()
+	defer bufferPool.Put(buf)
+	fmt.Fprintf(buf, "%s %s HTTP/1.1\r\n", req.Method, target)
+	writeHeader(buf, "Host", host)
+	for key, value := range headers {
+		writeHeader(buf, key, value)
+	}
+	// The body has already been read in full, so it is always sent with a length
+	if len(req.Body) > 0 || req.Method == "POST" || req.Method == "PUT" || req.Method == "PATCH" {
+		writeHeader(buf, "Content-Length", strconv.Itoa(len(req.Body)))
+	}
+	writeHeader(buf, "Connection", "close")
+	buf.WriteString("\r\n")
+	buf.Write(req.Body)
+	
+	_, err := upstreamConn.Write(buf.Bytes())
+	return err
+}
+
+// Remove hop headers deletes the hop-by-hop headers from a request or response header
+// set, along with any other headers its Connection header names
+func removeHopHeaders[V any](headers map[string]V, connection string) {
+	for _, name := range strings.Split(connection, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			delete(headers, textproto.CanonicalMIMEHeaderKey(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		delete(headers, name)
+	}
+}
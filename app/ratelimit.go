@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket tracks the available request tokens for a single client
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// RateLimiter enforces a per-IP token bucket limit
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter allowing rate requests per second
+// with bursts of up to burst requests
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow consumes a token for the given IP. When no token is available it
+// returns false along with how long the client should wait before retrying.
+func (rl *RateLimiter) Allow(ip string) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	now := time.Now()
+	bucket, exists := rl.buckets[ip]
+	if !exists {
+		bucket = &tokenBucket{tokens: rl.burst, lastRefill: now}
+		rl.buckets[ip] = bucket
+	}
+	
+	// Refill based on the time elapsed since the last request
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+elapsed*rl.rate)
+	bucket.lastRefill = now
+	
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	
+	wait := (1 - bucket.tokens) / rl.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// CleanupBuckets removes buckets for IPs that have been idle long enough to be full again
+func (rl *RateLimiter) CleanupBuckets() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	
+	now := time.Now()
+	refillTime := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for ip, bucket := range rl.buckets {
+		if now.Sub(bucket.lastRefill) > refillTime {
+			delete(rl.buckets, ip)
+		}
+	}
+}
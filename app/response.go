@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter collects a handler's status, headers and body, and sends them
+// as a single response when the handler returns
+type ResponseWriter struct {
+	conn        net.Conn
+	req         *Request
+	header      Header
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+// New response writer creates a writer for req whose headers start from the
+// request's prepared response headers
+func newResponseWriter(conn net.Conn, req *Request) *ResponseWriter {
+	header := req.ResponseHeaders.Clone()
+	return &ResponseWriter{conn: conn, req: req, header: header, statusCode: 200}
+}
+
+// Header returns the response headers, which can be changed until the first
+// call to WriteHeader or Write
+func (w *ResponseWriter) Header() Header {
+	return w.header
+}
+
+// Write header sets the response status. Only the first call has any effect.
+func (w *ResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+}
+
+// Write appends to the response body, setting a 200 status if none was written
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(200)
+	return w.body.Write(b)
+}
+
+// Finish sends the buffered response
+func (w *ResponseWriter) finish() {
+	headers := w.header.Clone()
+	contentType := headers.Get("Content-Type")
+	headers.Del("Content-Type")
+	
+	sendResponse(w.conn, w.statusCode, http.StatusText(w.statusCode), contentType, w.body.Bytes(), headers, w.req.Gzip, w.req.Close)
+}
+
+// With response writer adapts a handler written against ResponseWriter to a HandlerFunc
+func withResponseWriter(h func(w *ResponseWriter, req *Request)) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		w := newResponseWriter(conn, req)
+		h(w, req)
+		w.finish()
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestResponseWriterMatchesSendResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		headers     Header
+		gzip        bool
+		close       bool
+	}{
+		{name: "plain", status: 200, contentType: "text/plain", body: "hello"},
+		{name: "empty", status: 204},
+		// A single extra field, since fields go out in map order
+		{name: "headers", status: 201, contentType: "application/json", body: `{"ok":true}`,
+			headers: Header{"Set-Cookie": {"a=1", "b=2"}}},
+		{name: "gzip", status: 200, contentType: "text/plain", body: strings.Repeat("compress me ", 200), gzip: true},
+		{name: "close", status: 404, contentType: "text/plain", body: "gone", close: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := &recordConn{}
+			sendResponse(want, tt.status, http.StatusText(tt.status), tt.contentType, []byte(tt.body), tt.headers.Clone(), tt.gzip, tt.close)
+			
+			got := &recordConn{}
+			req := &Request{ResponseHeaders: tt.headers.Clone(), Gzip: tt.gzip, Close: tt.close}
+			withResponseWriter(func(w *ResponseWriter, req *Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})(got, req)
+			
+			if !bytes.Equal(got.buf.Bytes(), want.buf.Bytes()) {
+				t.Errorf("ResponseWriter wrote\n%q\nsendResponse wrote\n%q", got.buf.String(), want.buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Request describes an incoming request along with the response settings
+// handlers should pass on to sendResponse
+type Request struct {
+	Method  string
+	Path    string
+	Query   url.Values
+	Headers map[string]string
+	// HeaderFields holds the headers as sent, with a repeated field's values kept apart
+	HeaderFields map[string][]string
+	Body         []byte
+	// RemoteIP is the client's address, from X-Forwarded-For when the peer is a trusted proxy
+	RemoteIP string
+	// Params holds the path segments captured by the route's :name parameters
+	Params map[string]string
+	
+	// ResponseHeaders are the headers already prepared for the response
+	ResponseHeaders Header
+	// Gzip reports whether the client accepts gzip-encoded responses
+	Gzip bool
+	// Close reports whether the connection closes after this response
+	Close bool
+	
+	ctx context.Context
+	// started reports whether any of the response has been written
+	started func() bool
+}
+
+// Context returns the request's context. It carries the request ID and is
+// cancelled when the client disconnects or the request times out.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Param returns the value captured for a route parameter, or "" if there is none
+func (r *Request) Param(name string) string {
+	return r.Params[name]
+}
+
+// Form returns the fields of an application/x-www-form-urlencoded body, nil if the
+// request had none, or an error if the body is malformed
+func (r *Request) Form() (map[string][]string, error) {
+	return formFromContext(r.Context())
+}
+
+// HandlerFunc handles a routed request
+type HandlerFunc func(conn net.Conn, req *Request)
+
+// anyMethods are the methods listed in Allow for a route registered for any method
+var anyMethods = []string{"DELETE", "GET", "OPTIONS", "PATCH", "POST", "PUT"}
+
+// route is a single registered pattern
+type route struct {
+	method  string
+	pattern string
+	handler HandlerFunc
+	
+	// prefix is set for patterns ending in "*"; segments is set for all others
+	prefix   string
+	isPrefix bool
+	segments []string
+}
+
+// routeRank orders matching routes by specificity
+type routeRank struct {
+	// static marks, per path segment, whether the route matched it literally
+	static    []bool
+	prefixLen int
+}
+
+// Outranks reports whether a is a more specific match than b. Segment patterns beat
+// prefix patterns, static segments beat parameters from left to right, and longer
+// prefixes beat shorter ones.
+func (a routeRank) outranks(b routeRank) bool {
+	if (a.static == nil) != (b.static == nil) {
+		return a.static != nil
+	}
+	for i := range a.static {
+		if a.static[i] != b.static[i] {
+			return a.static[i]
+		}
+	}
+	return a.prefixLen > b.prefixLen
+}
+
+// Equal reports whether two ranks are equally specific
+func (a routeRank) equal(b routeRank) bool {
+	return !a.outranks(b) && !b.outranks(a)
+}
+
+// Router dispatches requests to handlers by method and path
+type Router struct {
+	routes     []route
+	notFound   HandlerFunc
+	middleware []Middleware
+}
+
+// NewRouter creates an empty router
+func NewRouter() *Router {
+	return &Router{notFound: notFoundHandler}
+}
+
+// Set not found handler replaces the handler used when no route matches.
+// Passing nil restores the default plain text 404.
+func (r *Router) SetNotFoundHandler(h HandlerFunc) {
+	if h == nil {
+		h = notFoundHandler
+	}
+	r.notFound = h
+}
+
+// Handle registers h for requests whose path matches pattern. An empty method
+// matches any method. A pattern ending in "*" matches every path starting with
+// the text before the "*". Any other pattern is matched segment by segment, where
+// a segment like ":id" captures the corresponding path segment into Request.Params.
+func (r *Router) Handle(method string, pattern string, h HandlerFunc) {
+	rt := route{method: method, pattern: pattern, handler: h}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		rt.prefix = prefix
+		rt.isPrefix = true
+	} else {
+		rt.segments = strings.Split(pattern, "/")
+	}
+	r.routes = append(r.routes, rt)
+}
+
+// Match finds the handler for a request, along with any parameters captured from
+// the path. When the most specific matching pattern has no route for the method,
+// the returned handler responds 405 Method Not Allowed. The handler is wrapped
+// in the router's middleware.
+func (r *Router) Match(method string, path string) (HandlerFunc, map[string]string) {
+	var best routeRank
+	var candidates []route
+	for _, rt := range r.routes {
+		rank, ok := rt.match(path, nil)
+		if !ok {
+			continue
+		}
+		if len(candidates) > 0 {
+			if best.outranks(rank) {
+				continue
+			}
+			if !rank.equal(best) {
+				candidates = candidates[:0]
+			}
+		}
+		best = rank
+		candidates = append(candidates, rt)
+	}
+	// TRACE would reflect the request back, cookies and credentials included, which
+	// cross-site tracing exploits, so it is refused on every path, routed or not
+	if method == "TRACE" {
+		return r.wrap(methodNotAllowedHandler(allowedMethods(candidates))), nil
+	}
+	if len(candidates) == 0 {
+		return r.wrap(r.notFound), nil
+	}
+	
+	var allowed []string
+	for _, rt := range candidates {
+		if rt.method == "" || rt.method == method {
+			params := map[string]string{}
+			rt.match(path, params)
+			return r.wrap(rt.handler), params
+		}
+		allowed = append(allowed, rt.method)
+	}
+	return r.wrap(methodNotAllowedHandler(allowed)), nil
+}
+
+// Match checks whether the route matches path, storing captured parameters in
+// params when it is non-nil
+func (rt route) match(path string, params map[string]string) (routeRank, bool) {
+	if rt.isPrefix {
+		if !strings.HasPrefix(path, rt.prefix) {
+			return routeRank{}, false
+		}
+		return routeRank{prefixLen: len(rt.prefix)}, true
+	}
+	
+	parts := strings.Split(path, "/")
+	if len(parts) != len(rt.segments) {
+		return routeRank{}, false
+	}
+	static := make([]bool, len(parts))
+	for i, segment := range rt.segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok && name != "" {
+			if parts[i] == "" {
+				return routeRank{}, false
+			}
+			if params != nil {
+				params[name] = parts[i]
+			}
+			continue
+		}
+		if segment != parts[i] {
+			return routeRank{}, false
+		}
+		static[i] = true
+	}
+	return routeRank{static: static}, true
+}
+
+// Not found handler is the default response for unmatched paths
+func notFoundHandler(conn net.Conn, req *Request) {
+	writeError(conn, 404, "Not Found", req.ResponseHeaders, req.Headers["Accept"])
+}
+
+// Allowed methods lists the methods the given routes accept, for an Allow header.
+// A route that accepts any method, or no route at all, stands for anyMethods.
+func allowedMethods(routes []route) []string {
+	if len(routes) == 0 {
+		return append([]string(nil), anyMethods...)
+	}
+	var allowed []string
+	for _, rt := range routes {
+		if rt.method == "" {
+			return append([]string(nil), anyMethods...)
+		}
+		allowed = append(allowed, rt.method)
+	}
+	return allowed
+}
+
+// Method not allowed handler responds 405 with an Allow header listing the accepted methods
+func methodNotAllowedHandler(allowed []string) HandlerFunc {
+	sort.Strings(allowed)
+	return func(conn net.Conn, req *Request) {
+		req.ResponseHeaders.Set("Allow", strings.Join(allowed, ", "))
+		writeError(conn, 405, "Method not allowed", req.ResponseHeaders, req.Headers["Accept"])
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// namedRouter registers each pattern with a handler that records its name, so a
+// test can tell which route a request reached
+func namedRouter(routes ...[3]string) (*Router, *string) {
+	r := NewRouter()
+	reached := new(string)
+	for _, rt := range routes {
+		name := rt[2]
+		r.Handle(rt[0], rt[1], func(conn net.Conn, req *Request) {
+			*reached = name
+		})
+	}
+	return r, reached
+}
+
+// Dispatch runs the handler r matches for a request and returns the name of the
+// route it reached, "" if none did, along with the captured parameters
+func dispatch(r *Router, reached *string, method string, path string) (string, map[string]string, *recordConn) {
+	*reached = ""
+	h, params := r.Match(method, path)
+	conn := &recordConn{}
+	h(conn, &Request{Method: method, Path: path, Headers: map[string]string{}, ResponseHeaders: Header{}})
+	return *reached, params, conn
+}
+
+func TestRouterParams(t *testing.T) {
+	r, reached := namedRouter([3]string{"", "/a/:x/:y", "xy"})
+	
+	name, params, _ := dispatch(r, reached, "GET", "/a/1/2")
+	if name != "xy" {
+		t.Fatalf("/a/1/2 reached %q, want xy", name)
+	}
+	if want := map[string]string{"x": "1", "y": "2"}; !reflect.DeepEqual(params, want) {
+		t.Errorf("params = %v, want %v", params, want)
+	}
+	
+	for _, path := range []string{"/a/1", "/a/1/2/3", "/a//2", "/a/1/", "/b/1/2"} {
+		if name, _, conn := dispatch(r, reached, "GET", path); name != "" {
+			t.Errorf("%s reached %q, want no route", path, name)
+		} else if status := conn.response(t).StatusCode; status != 404 {
+			t.Errorf("%s: status %d, want 404", path, status)
+		}
+	}
+}
+
+func TestRouterStaticBeatsParam(t *testing.T) {
+	// Registration order must not matter
+	orders := [][][3]string{
+		{{"", "/a/b", "static"}, {"", "/a/:x", "param"}},
+		{{"", "/a/:x", "param"}, {"", "/a/b", "static"}},
+	}
+	for _, routes := range orders {
+		r, reached := namedRouter(routes...)
+		if name, params, _ := dispatch(r, reached, "GET", "/a/b"); name != "static" || len(params) != 0 {
+			t.Errorf("/a/b reached %q with %v, want static with no params", name, params)
+		}
+		if name, params, _ := dispatch(r, reached, "GET", "/a/c"); name != "param" || params["x"] != "c" {
+			t.Errorf("/a/c reached %q with %v, want param with x=c", name, params)
+		}
+	}
+	
+	// The leftmost static segment decides
+	r, reached := namedRouter([3]string{"", "/:x/b", "param first"}, [3]string{"", "/a/:y", "static first"})
+	if name, _, _ := dispatch(r, reached, "GET", "/a/b"); name != "static first" {
+		t.Errorf("/a/b reached %q, want static first", name)
+	}
+}
+
+func TestRouterSegmentBeatsPrefix(t *testing.T) {
+	r, reached := namedRouter(
+		[3]string{"", "/*", "root"},
+		[3]string{"", "/a/*", "a prefix"},
+		[3]string{"", "/a/b/*", "ab prefix"},
+		[3]string{"", "/a/:x", "segment"},
+	)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/a/b", "segment"},
+		{"/a/c", "segment"},
+		{"/a/c/d", "a prefix"},
+		{"/a/b/c", "ab prefix"},
+		{"/z", "root"},
+	}
+	for _, tt := range tests {
+		if name, _, _ := dispatch(r, reached, "GET", tt.path); name != tt.want {
+			t.Errorf("%s reached %q, want %q", tt.path, name, tt.want)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	r, reached := namedRouter(
+		[3]string{"POST", "/a/b", "post"},
+		[3]string{"PUT", "/a/b", "put"},
+		[3]string{"GET", "/a/:x", "get param"},
+	)
+	if name, _, _ := dispatch(r, reached, "PUT", "/a/b"); name != "put" {
+		t.Errorf("PUT /a/b reached %q, want put", name)
+	}
+	
+	// Only the most specific pattern counts, so GET doesn't fall back to /a/:x
+	name, _, conn := dispatch(r, reached, "GET", "/a/b")
+	if name != "" {
+		t.Fatalf("GET /a/b reached %q, want a 405", name)
+	}
+	resp := conn.response(t)
+	if resp.StatusCode != 405 {
+		t.Errorf("status %d, want 405", resp.StatusCode)
+	}
+	if allow := resp.Header.Get("Allow"); allow != "POST, PUT" {
+		t.Errorf("Allow = %q, want %q", allow, "POST, PUT")
+	}
+}
+
+func TestSetNotFoundHandler(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	s.SetNotFoundHandler(func(conn net.Conn, req *Request) {
+		sendResponse(conn, 404, "Not Found", "text/html", []byte("<h1>Lost</h1>"), req.ResponseHeaders, false, req.Close)
+	})
+	
+	resp := roundTrip(t, s, "GET /nowhere HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if body := responseBody(t, resp); resp.StatusCode != 404 || body != "<h1>Lost</h1>" {
+		t.Errorf("custom handler: status %d body %q, want 404 <h1>Lost</h1>", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/html" {
+		t.Errorf("custom handler: Content-Type = %q, want text/html", contentType)
+	}
+	
+	// Routed paths are unaffected
+	resp = roundTrip(t, s, "GET /echo/abc HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if body := responseBody(t, resp); resp.StatusCode != 200 || body != "abc" {
+		t.Errorf("routed path: status %d body %q, want 200 abc", resp.StatusCode, body)
+	}
+	
+	// nil restores the default
+	s.SetNotFoundHandler(nil)
+	resp = roundTrip(t, s, "GET /nowhere HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	if body := responseBody(t, resp); resp.StatusCode != 404 || body != "Not Found" {
+		t.Errorf("after nil: status %d body %q, want 404 Not Found", resp.StatusCode, body)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/plain" {
+		t.Errorf("after nil: Content-Type = %q, want text/plain", contentType)
+	}
+}
+
+func TestFilesRoutesAllow(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{})
+	tests := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{"TRACE", "/files/x.txt", "DELETE, GET, PATCH, POST, PUT"},
+		{"OPTIONS", "/files/x.txt", "DELETE, GET, PATCH, POST, PUT"},
+		{"TRACE", "/files", "DELETE, GET, POST"},
+		{"TRACE", "/files/", "DELETE, GET, POST"},
+		{"PUT", "/files/", "DELETE, GET, POST"},
+	}
+	for _, tt := range tests {
+		resp := roundTrip(t, s, tt.method+" "+tt.path+" HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		if resp.StatusCode != 405 || resp.Header.Get("Allow") != tt.allow {
+			t.Errorf("%s %s: status %d Allow %q, want 405 with %q", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"), tt.allow)
+		}
+	}
+}
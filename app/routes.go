@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Routes registers the server's endpoints
+func (s *Server) routes() *Router {
+	router := NewRouter()
+	router.Use(s.securityHeaders)
+	if s.config.RequestTimeout > 0 {
+		router.Use(s.timeoutMiddleware)
+	}
+	router.Use(s.corsMiddleware)
+	router.Use(s.authMiddleware)
+	
+	router.Handle("", "/", s.handleRoot)
+	router.Handle("", "/echo/*", withResponseWriter(s.handleEcho))
+	router.Handle("GET", "/user-agent", withResponseWriter(s.handleUserAgent))
+	router.Handle("", "/api/status", s.handleAPIStatus)
+	router.Handle("", "/api/time", s.handleAPITime)
+	router.Handle("POST", "/api/echo", s.handleAPIEcho)
+	router.Handle("PUT", "/api/echo", s.handleAPIEcho)
+	router.Handle("", "/api/session", s.handleAPISession)
+	router.Handle("GET", "/api/delay/:seconds", s.handleAPIDelay)
+	router.Handle("", "/api/status/:code", s.handleAPIStatusCode)
+	router.Handle("GET", "/api/events", s.handleAPIEvents)
+	router.Handle("GET", "/api/cookies", s.handleAPICookies)
+	router.Handle("", "/api/anything", s.handleAPIAnything)
+	router.Handle("", "/api/anything/*", s.handleAPIAnything)
+	router.Handle("GET", "/ws", s.handleWebSocketEcho)
+	// Registered per method so a 405, TRACE's included, lists the methods each accepts
+	for _, method := range filesRootMethods {
+		router.Handle(method, "/files", s.handleFilesRoute)
+		router.Handle(method, "/files/", s.handleFilesRoute)
+	}
+	for _, method := range fileMethods {
+		router.Handle(method, "/files/*", s.handleFilesRoute)
+	}
+	return router
+}
+
+// Handle root serves the configured index file to GET requests when it exists, and
+// the welcome message otherwise
+func (s *Server) handleRoot(conn net.Conn, req *Request) {
+	if s.config.IndexFile != "" && req.Method == "GET" && s.serveIndexFile(conn, req) {
+		return
+	}
+	withResponseWriter(s.handleWelcome)(conn, req)
+}
+
+// Serve index file sends the index file from the server directory, reporting false
+// without responding if there is no such regular file
+func (s *Server) serveIndexFile(conn net.Conn, req *Request) bool {
+	indexPath := filepath.Join(s.config.Directory, s.config.IndexFile)
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	
+	etag := generateETag(info)
+	req.ResponseHeaders.Set("ETag", etag)
+	req.ResponseHeaders.Set("Last-Modified", info.ModTime().UTC().Format(httpTimeFormat))
+	if notModified(req.Headers, etag, info.ModTime()) {
+		sendResponse(conn, 304, "Not Modified", "", nil, req.ResponseHeaders, false, req.Close)
+		return true
+	}
+	
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeError(conn, 500, "Error reading file", req.ResponseHeaders, req.Headers["Accept"])
+		return true
+	}
+	contentType := detectContentType(indexPath, head[:n])
+	if err := s.serveContent(conn, file, info.Size(), contentType, etag, req.Headers, req.ResponseHeaders, req.Gzip, req.Close); err != nil {
+		log.Printf("Error streaming %s: %v", indexPath, err)
+	}
+	return true
+}
+
+// Handle welcome serves the welcome message
+func (s *Server) handleWelcome(w *ResponseWriter, req *Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("Welcome to the Go Web Server"))
+}
+
+// Handle echo responds with the rest of the path after /echo/
+func (s *Server) handleEcho(w *ResponseWriter, req *Request) {
+	echoString := strings.TrimPrefix(req.Path, "/echo/")
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(echoString))
+}
+
+// Handle user agent responds with the client's User-Agent header
+func (s *Server) handleUserAgent(w *ResponseWriter, req *Request) {
+	userAgent := req.Headers["User-Agent"]
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(userAgent))
+}
+
+// Handle API status reports that the server is up, as JSON or plain text
+func (s *Server) handleAPIStatus(conn net.Conn, req *Request) {
+	status := map[string]string{
+		"status": "ok",
+		"time":   time.Now().Format(time.RFC3339),
+	}
+	writeNegotiated(conn, 200, status, req.ResponseHeaders, req.Headers["Accept"], req.Gzip, req.Close)
+}
+
+// Handle API time reports the server's current time, as JSON or plain text
+func (s *Server) handleAPITime(conn net.Conn, req *Request) {
+	timeData := map[string]string{
+		"time": time.Now().Format(time.RFC3339),
+	}
+	writeNegotiated(conn, 200, timeData, req.ResponseHeaders, req.Headers["Accept"], req.Gzip, req.Close)
+}
+
+// Handle API echo responds with the JSON request body, or with the fields of a form
+// body as a JSON object of value lists
+func (s *Server) handleAPIEcho(conn net.Conn, req *Request) {
+	form, err := req.Form()
+	if err != nil {
+		writeError(conn, 400, err.Error(), req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	if form != nil {
+		writeJSON(conn, 200, form, req.ResponseHeaders, req.Gzip, req.Close)
+		return
+	}
+	
+	var payload json.RawMessage
+	if err := s.decodeJSON(req.Body, &payload); err != nil {
+		writeError(conn, jsonErrorStatus(err), err.Error(), req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	writeJSON(conn, 200, payload, req.ResponseHeaders, req.Gzip, req.Close)
+}
+
+// Handle API cookies lists the cookies the client sent as JSON
+func (s *Server) handleAPICookies(conn net.Conn, req *Request) {
+	writeJSON(conn, 200, parseCookies([]string{req.Headers["Cookie"]}), req.ResponseHeaders, req.Gzip, req.Close)
+}
+
+// AnythingResponse reflects a request back to the client
+type AnythingResponse struct {
+	Method  string              `json:"method"`
+	Path    string              `json:"path"`
+	Query   url.Values          `json:"query"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+	Origin  string              `json:"origin"`
+}
+
+// Handle API anything describes the request it received as JSON, like httpbin's
+// /anything, to help debug clients. Each header maps to the values it was sent
+// with, one per line, like the query's parameters.
+func (s *Server) handleAPIAnything(conn net.Conn, req *Request) {
+	query := req.Query
+	if query == nil {
+		query = url.Values{}
+	}
+	anything := AnythingResponse{
+		Method:  req.Method,
+		Path:    req.Path,
+		Query:   query,
+		Headers: req.HeaderFields,
+		Body:    string(req.Body),
+		Origin:  req.RemoteIP,
+	}
+	writeJSON(conn, 200, anything, req.ResponseHeaders, req.Gzip, req.Close)
+}
+
+// Handle API status code answers with whatever status the client asks for, so it
+// can exercise its error handling. The body is the status text.
+func (s *Server) handleAPIStatusCode(conn net.Conn, req *Request) {
+	code, err := strconv.Atoi(req.Param("code"))
+	if err != nil || code < 100 || code > 599 {
+		writeError(conn, 400, "Status code must be a number from 100 to 599", req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	
+	statusText := http.StatusText(code)
+	if statusText == "" {
+		statusText = "Unknown Status"
+	}
+	
+	// These statuses can't carry a body, and an informational status isn't a final
+	// response, so the connection is closed after it to avoid leaving the client waiting
+	switch {
+	case code < 200:
+		sendResponse(conn, code, statusText, "", nil, req.ResponseHeaders, false, true)
+		conn.Close()
+	case code == 204 || code == 304:
+		sendResponse(conn, code, statusText, "", nil, req.ResponseHeaders, false, req.Close)
+	default:
+		sendResponse(conn, code, statusText, "text/plain", []byte(statusText), req.ResponseHeaders, req.Gzip, req.Close)
+	}
+}
+
+// Handle API delay waits the requested number of seconds, up to MaxDelay, before
+// answering, so clients can test their timeouts. The wait ends early if the client
+// goes away.
+func (s *Server) handleAPIDelay(conn net.Conn, req *Request) {
+	seconds, err := strconv.ParseFloat(req.Param("seconds"), 64)
+	if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		writeError(conn, 400, "Delay must be a non-negative number of seconds", req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	
+	// Compare in seconds, since a huge request would overflow a Duration
+	maxDelay := time.Duration(s.config.MaxDelay)
+	capped := seconds > maxDelay.Seconds()
+	delay := maxDelay
+	if !capped {
+		delay = time.Duration(seconds * float64(time.Second))
+	}
+	
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+		return
+	}
+	
+	result := map[string]interface{}{
+		"delay":  delay.Seconds(),
+		"capped": capped,
+	}
+	writeJSON(conn, 200, result, req.ResponseHeaders, req.Gzip, req.Close)
+}
+
+// Handle API events streams the server time once a second as Server-Sent Events.
+// With ?count=N the stream ends after N events.
+func (s *Server) handleAPIEvents(conn net.Conn, req *Request) {
+	count := 0
+	if value := req.Query.Get("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			writeError(conn, 400, "Count must be a positive number", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		count = parsed
+	}
+	
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for sent := 0; count == 0 || sent < count; sent++ {
+			select {
+			case now := <-ticker.C:
+				select {
+				case events <- now.Format(time.RFC3339):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	s.writeSSE(conn, req, events)
+}
+
+// Handle API session reports the caller's session
+func (s *Server) handleAPISession(conn net.Conn, req *Request) {
+	timestamp, _ := s.sessionManager.GetSession(getSessionCookie(req.Headers["Cookie"]))
+	sessionInfo := map[string]interface{}{
+		"session_id": getSessionCookie(req.Headers["Cookie"]),
+		"created_at": timestamp.Format(time.RFC3339),
+		"age":        time.Since(timestamp).String(),
+	}
+	writeJSON(conn, 200, sessionInfo, req.ResponseHeaders, req.Gzip, req.Close)
+}
+
+// Handle files route adapts the /files endpoints to the router
+func (s *Server) handleFilesRoute(conn net.Conn, req *Request) {
+	s.handleFiles(conn, req.Method, req.Path, req.Query, req.Headers, req.Body, req.ResponseHeaders, req.Gzip, req.Close)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// Write SSE streams events to the client as Server-Sent Events until the channel is
+// closed, the client goes away or the server begins shutting down. Whenever
+// SSEHeartbeat passes, a comment line is sent as a heartbeat so idle proxies keep the
+// connection open. The stream is never compressed, and since its end is marked by
+// the connection closing, the connection is closed when it returns.
+func (s *Server) writeSSE(conn net.Conn, req *Request, events <-chan string) error {
+	defer conn.Close()
+	
+	headers := req.ResponseHeaders.Clone()
+	headers.Set("Cache-Control", "no-cache")
+	
+	recordStatus(conn, 200)
+	head := getBuffer()
+	writeResponseHead(head, responseProto(conn), 200, "OK", "text/event-stream", headers, true)
+	head.WriteString("\r\n")
+	_, err := conn.Write(head.Bytes())
+	bufferPool.Put(head)
+	if err != nil {
+		return err
+	}
+	if err := flushConn(conn); err != nil {
+		return err
+	}
+	
+	var heartbeat <-chan time.Time
+	if s.config.SSEHeartbeat > 0 {
+		ticker := time.NewTicker(time.Duration(s.config.SSEHeartbeat))
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	
+	message := getBuffer()
+	defer bufferPool.Put(message)
+	for {
+		message.Reset()
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+			// A multi-line event is sent as one data line per line
+			for _, line := range strings.Split(event, "\n") {
+				message.WriteString("data: ")
+				message.WriteString(line)
+				message.WriteString("\n")
+			}
+			message.WriteString("\n")
+		case <-heartbeat:
+			message.WriteString(": heartbeat\n\n")
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case <-s.stopping:
+			return nil
+		}
+		
+		if _, err := conn.Write(message.Bytes()); err != nil {
+			return err
+		}
+		if err := flushConn(conn); err != nil {
+			return err
+		}
+	}
+}
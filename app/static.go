@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// staticFiles are the assets bundled into the binary, served under /static
+//
+//go:embed static
+var staticFiles embed.FS
+
+// Mount FS serves the files of fsys under prefix, read-only, so with the prefix /static
+// the file css/site.css is served at /static/css/site.css. A directory's index.html is
+// served for the directory itself. Methods other than GET get a 405. The files are
+// assumed not to change, so their ETags are worked out once here from their content.
+func (s *Server) MountFS(prefix string, fsys fs.FS) error {
+	etags := map[string]string{}
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		etags[name] = fmt.Sprintf("\"%x\"", sum[:8])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		prefix = ""
+	}
+	
+	handler := s.fsHandler(prefix, fsys, etags)
+	if prefix != "" {
+		s.router.Handle("GET", prefix, handler)
+	}
+	s.router.Handle("GET", prefix+"/*", handler)
+	return nil
+}
+
+// FS handler serves a file of a mounted FS with the same content type detection,
+// conditional requests and ranges as files on disk
+func (s *Server) fsHandler(prefix string, fsys fs.FS, etags map[string]string) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		name, err := url.PathUnescape(strings.TrimPrefix(req.Path, prefix))
+		if err != nil {
+			writeError(conn, 400, "Invalid URL encoding", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		name = strings.Trim(name, "/")
+		if name == "" {
+			name = "."
+		}
+		if !fs.ValidPath(name) {
+			writeError(conn, 404, "File not found", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		if info, err := fs.Stat(fsys, name); err == nil && info.IsDir() {
+			name = path.Join(name, "index.html")
+		}
+		
+		etag, ok := etags[name]
+		if !ok {
+			writeError(conn, 404, "File not found", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		if cacheControl := s.staticCacheControl(path.Base(name)); cacheControl != "" {
+			req.ResponseHeaders.Set("Cache-Control", cacheControl)
+		}
+		req.ResponseHeaders.Set("ETag", etag)
+		if etagMatches(req.Headers["If-None-Match"], etag) {
+			sendResponse(conn, 304, "Not Modified", "", nil, req.ResponseHeaders, false, req.Close)
+			return
+		}
+		
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			writeError(conn, 500, "Error reading file", req.ResponseHeaders, req.Headers["Accept"])
+			return
+		}
+		contentType := detectContentType(name, content)
+		if err := s.serveContent(conn, bytes.NewReader(content), int64(len(content)), contentType, etag, req.Headers, req.ResponseHeaders, req.Gzip, req.Close); err != nil {
+			log.Printf("Error streaming %s: %v", name, err)
+		}
+	}
+}
+
+// Serve content sends content whole, or the single byte range a Range header asks
+// for with 206 Partial Content. The range is ignored when If-Range names an ETag
+// other than the current one, since the client's partial copy is out of date.
+func (s *Server) serveContent(
+	conn net.Conn,
+	content io.ReadSeeker,
+	size int64,
+	contentType string,
+	etag string,
+	headers map[string]string,
+	responseHeaders Header,
+	clientSupportsGzip bool,
+	closeConn bool,
+) error {
+	responseHeaders.Set("Accept-Ranges", "bytes")
+	rangeHeader := headers["Range"]
+	if ifRange, ok := headers["If-Range"]; ok && ifRange != etag {
+		rangeHeader = ""
+	}
+	
+	start, end, status := parseRange(rangeHeader, size)
+	switch status {
+	case 416:
+		responseHeaders.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeError(conn, 416, "Range not satisfiable", responseHeaders, headers["Accept"])
+		return nil
+	case 206:
+		if _, err := content.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		responseHeaders.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		// Offsets refer to the identity encoding, so partial content is never gzipped
+		return sendStream(conn, 206, "Partial Content", contentType, content, end-start+1, s.withHTMLHeaders(contentType, responseHeaders), false, closeConn)
+	}
+	return sendStream(conn, 200, "OK", contentType, content, size, s.withHTMLHeaders(contentType, responseHeaders), clientSupportsGzip, closeConn)
+}
+
+// Parse range reads a Range header of the form bytes=first-last, bytes=first- or
+// bytes=-suffix for content of the given size. It returns the offsets of the first
+// and last bytes with status 206, or 416 when the range lies beyond the content.
+// Anything else, including several ranges at once, returns 200 and the whole
+// content is sent, as RFC 9110 section 14.2 allows.
+func parseRange(value string, size int64) (int64, int64, int) {
+	spec, ok := strings.CutPrefix(value, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, 200
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, 200
+	}
+	
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix < 0 {
+			return 0, 0, 200
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, 416
+		}
+		return max(size-suffix, 0), size - 1, 206
+	}
+	
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, 200
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, 200
+		}
+	}
+	if start >= size {
+		return 0, 0, 416
+	}
+	return start, min(end, size-1), 206
+}
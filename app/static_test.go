@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestEmbeddedAssetsOptIn(t *testing.T) {
+	captureLog(t)
+	for _, enabled := range []bool{false, true} {
+		s := newTestServer(t, Config{EmbeddedAssets: enabled})
+		resp := roundTrip(t, s, "GET /static/style.css HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		want := 404
+		if enabled {
+			want = 200
+		}
+		if resp.StatusCode != want {
+			t.Errorf("EmbeddedAssets=%v: status %d, want %d", enabled, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// errHandlerTimeout is returned by writes from a handler that ran past its deadline
+var errHandlerTimeout = errors.New("handler timed out")
+
+// timeoutConn guards a connection shared with a handler that may outlive its
+// deadline, dropping anything the handler writes once the request has timed out
+type timeoutConn struct {
+	net.Conn
+	mu       sync.Mutex
+	wrote    bool
+	timedOut bool
+}
+
+// Write passes b through unless the request has timed out
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timedOut {
+		return 0, errHandlerTimeout
+	}
+	c.wrote = true
+	return c.Conn.Write(b)
+}
+
+// Flush flushes the underlying connection unless the request has timed out
+func (c *timeoutConn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timedOut {
+		return errHandlerTimeout
+	}
+	return flushConn(c.Conn)
+}
+
+// Close closes the underlying connection unless the request has timed out, after
+// which the connection no longer belongs to the handler
+func (c *timeoutConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timedOut {
+		return errHandlerTimeout
+	}
+	return c.Conn.Close()
+}
+
+// Set status records the response status unless the request has timed out
+func (c *timeoutConn) setStatus(statusCode int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.timedOut {
+		recordStatus(c.Conn, statusCode)
+	}
+}
+
+// Protocol returns the protocol version of the underlying connection
+func (c *timeoutConn) protocol() string {
+	return responseProto(c.Conn)
+}
+
+// Started reports whether the handler has written any of its response
+func (c *timeoutConn) started() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.wrote
+}
+
+// Hijack hands the underlying connection over unless the request has timed out
+func (c *timeoutConn) hijack() (*bufio.Reader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timedOut {
+		return nil, errHandlerTimeout
+	}
+	return hijackConn(c.Conn)
+}
+
+// Time out stops further writes and reports whether the handler had started its response
+func (c *timeoutConn) timeOut() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timedOut = true
+	return c.wrote
+}
+
+// Timeout middleware gives each handler RequestTimeout to finish. If it runs
+// over, its context is cancelled and the client gets a 503, or the connection
+// is closed if part of the response has already been written.
+func (s *Server) timeoutMiddleware(next HandlerFunc) HandlerFunc {
+	return func(conn net.Conn, req *Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Duration(s.config.RequestTimeout))
+		defer cancel()
+		req.ctx = ctx
+		
+		// The handler keeps the request after a timeout, so the 503 uses its own copy of the headers
+		headers := req.ResponseHeaders.Clone()
+		
+		guarded := &timeoutConn{Conn: conn}
+		req.started = guarded.started
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// A panic here would take the whole server down, so it is recovered in this goroutine
+			defer recoverPanic(guarded, req)
+			next(guarded, req)
+		}()
+		
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		
+		log.Printf("request_id=%s timed out after %s", requestIDFromContext(ctx), time.Duration(s.config.RequestTimeout))
+		if guarded.timeOut() {
+			// A partial response can't be completed, so the connection can't be reused
+			conn.Close()
+			return
+		}
+		writeError(conn, 503, "Request timed out", headers, req.Headers["Accept"])
+	}
+}
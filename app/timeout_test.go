@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{RequestTimeout: Duration(20 * time.Millisecond)})
+	
+	release := make(chan struct{})
+	lateWrite := make(chan error, 1)
+	slow := func(conn net.Conn, req *Request) {
+		<-req.Context().Done()
+		<-release
+		_, err := conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nlate"))
+		lateWrite <- err
+	}
+	
+	conn := &recordConn{}
+	req := &Request{Headers: map[string]string{}, ResponseHeaders: Header{}}
+	s.timeoutMiddleware(slow)(conn, req)
+	
+	resp := conn.response(t)
+	if resp.StatusCode != 503 {
+		t.Fatalf("status %d, want 503", resp.StatusCode)
+	}
+	if body := responseBody(t, resp); body != "Request timed out" {
+		t.Errorf("body %q, want %q", body, "Request timed out")
+	}
+	
+	// The handler carries on after the 503, but nothing it writes reaches the client
+	written := conn.buf.String()
+	close(release)
+	select {
+	case err := <-lateWrite:
+		if !errors.Is(err, errHandlerTimeout) {
+			t.Errorf("late write returned %v, want errHandlerTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler never wrote")
+	}
+	if conn.buf.String() != written {
+		t.Errorf("late write reached the connection: %q", strings.TrimPrefix(conn.buf.String(), written))
+	}
+}
+
+func TestTimeoutMiddlewareFastHandler(t *testing.T) {
+	s := newTestServer(t, Config{RequestTimeout: Duration(time.Second)})
+	conn := &recordConn{}
+	req := &Request{Headers: map[string]string{}, ResponseHeaders: Header{}}
+	s.timeoutMiddleware(func(conn net.Conn, req *Request) {
+		sendResponse(conn, 200, "OK", "text/plain", []byte("quick"), req.ResponseHeaders, false, false)
+	})(conn, req)
+	
+	resp := conn.response(t)
+	if body := responseBody(t, resp); resp.StatusCode != 200 || body != "quick" {
+		t.Errorf("status %d body %q, want 200 quick", resp.StatusCode, body)
+	}
+}
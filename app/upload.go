@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleUploadAge is how long a resumable upload may go without a new piece before
+// it is abandoned and its partial file removed
+const staleUploadAge = time.Hour
+
+// resumableUpload tracks a file being uploaded in pieces with Content-Range
+type resumableUpload struct {
+	total int64
+	// received holds the inclusive byte ranges written so far, sorted and disjoint
+	received [][2]int64
+	// partPath is the hidden file the pieces are written into
+	partPath string
+	// updated is when the last piece arrived
+	updated time.Time
+}
+
+// Overlaps reports whether any byte from start to end has already been received
+func (u *resumableUpload) overlaps(start int64, end int64) bool {
+	for _, r := range u.received {
+		if start <= r[1] && end >= r[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records a received range, merging it with its neighbours
+func (u *resumableUpload) add(start int64, end int64) {
+	u.received = append(u.received, [2]int64{start, end})
+	sort.Slice(u.received, func(i, j int) bool { return u.received[i][0] < u.received[j][0] })
+	
+	merged := u.received[:1]
+	for _, r := range u.received[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] == last[1]+1 {
+			last[1] = r[1]
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	u.received = merged
+}
+
+// Received prefix returns how many bytes from the start of the file have arrived
+// without a gap
+func (u *resumableUpload) receivedPrefix() int64 {
+	if len(u.received) == 0 || u.received[0][0] != 0 {
+		return 0
+	}
+	return u.received[0][1] + 1
+}
+
+// Parse content range parses a request's "bytes start-end/total" Content-Range.
+// "bytes */total" asks how much of an upload has arrived, and gives a start of -1.
+func parseContentRange(value string) (int64, int64, int64, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New("Content-Range must be in bytes")
+	}
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errors.New("Content-Range needs a total size")
+	}
+	total, err := strconv.ParseInt(totalPart, 10, 64)
+	if err != nil || total <= 0 {
+		return 0, 0, 0, errors.New("Content-Range total must be a positive number")
+	}
+	if rangePart == "*" {
+		return -1, -1, total, nil
+	}
+	
+	startPart, endPart, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return 0, 0, 0, errors.New("Content-Range needs a start and an end")
+	}
+	// ParseUint rejects signs, so negative offsets never get this far
+	start, startErr := strconv.ParseUint(startPart, 10, 63)
+	end, endErr := strconv.ParseUint(endPart, 10, 63)
+	if startErr != nil || endErr != nil || start > end {
+		return 0, 0, 0, errors.New("Content-Range start and end must be offsets with start before end")
+	}
+	return int64(start), int64(end), total, nil
+}
+
+// Upload part path returns the hidden partial file a resumable upload to filePath is
+// written into, hidden so it stays out of directory listings
+func uploadPartPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".upload")
+}
+
+// Expire uploads abandons resumable uploads that have gone longer than maxAge
+// without a new piece, removing their partial files
+func (s *Server) expireUploads(maxAge time.Duration) {
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+	for filePath, upload := range s.uploads {
+		if time.Since(upload.updated) > maxAge {
+			os.Remove(upload.partPath)
+			delete(s.uploads, filePath)
+		}
+	}
+}
+
+// Remove orphaned uploads deletes partial files left in dir by a previous run.
+// Uploads in progress are only kept in memory, so none of them can be resumed.
+func removeOrphanedUploads(dir string) {
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() && strings.HasPrefix(entry.Name(), ".") && strings.HasSuffix(entry.Name(), ".upload") {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing partial upload %s: %v", path, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Handle file upload range writes one piece of a resumable upload at the offset its
+// Content-Range gives, into a hidden partial file beside the target. Until every byte
+// has arrived the reply is a 308 whose Range header holds the bytes received from the
+// start of the file, so a client whose connection dropped knows where to resume; it can
+// also ask with an empty "bytes */total" PUT. The last piece moves the file into place
+// and gets a 201, or a 200 if it replaced a file. Uploads in progress are kept in memory,
+// so a restart means starting over.
+func (s *Server) handleFileUploadRange(
+	conn net.Conn,
+	filePath string,
+	contentRange string,
+	body []byte,
+	contentType string,
+	responseHeaders Header,
+	accept string,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	start, end, total, err := parseContentRange(contentRange)
+	if err != nil {
+		writeError(conn, 400, "Invalid Content-Range: "+err.Error(), responseHeaders, accept)
+		return
+	}
+	if s.config.MaxUploadSize > 0 && total > s.config.MaxUploadSize {
+		writeError(conn, 413, "File too large", responseHeaders, accept)
+		return
+	}
+	info, err := os.Stat(filePath)
+	existed := err == nil
+	if existed && info.IsDir() {
+		writeError(conn, 409, "Target is a directory", responseHeaders, accept)
+		return
+	}
+	
+	// Pieces are written one at a time, which keeps the bookkeeping simple
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+	
+	upload := s.uploads[filePath]
+	if upload != nil && upload.total != total {
+		writeError(conn, 409, "Content-Range total does not match the upload in progress", responseHeaders, accept)
+		return
+	}
+	if start < 0 {
+		if upload == nil {
+			upload = &resumableUpload{total: total}
+		}
+		s.sendUploadProgress(conn, upload, responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	if end >= total {
+		responseHeaders.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		writeError(conn, 416, "Content-Range goes past the total size", responseHeaders, accept)
+		return
+	}
+	if int64(len(body)) != end-start+1 {
+		writeError(conn, 400, "Body length does not match Content-Range", responseHeaders, accept)
+		return
+	}
+	if upload != nil && upload.overlaps(start, end) {
+		writeError(conn, 409, "Content-Range overlaps bytes already received", responseHeaders, accept)
+		return
+	}
+	
+	partPath := uploadPartPath(filePath)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	// A new upload starts from an empty file, which also drops any partial file a
+	// restart left behind. It grows as pieces arrive rather than being allocated at
+	// the claimed total, so a total alone costs nothing.
+	flags := os.O_WRONLY | os.O_CREATE
+	if upload == nil {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	_, err = file.WriteAt(body, start)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	
+	if upload == nil {
+		upload = &resumableUpload{total: total, partPath: partPath}
+		s.uploads[filePath] = upload
+	}
+	upload.updated = time.Now()
+	upload.add(start, end)
+	if upload.receivedPrefix() < total {
+		s.sendUploadProgress(conn, upload, responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	
+	delete(s.uploads, filePath)
+	if err := os.Rename(partPath, filePath); err != nil {
+		os.Remove(partPath)
+		writeError(conn, 500, "Error writing file", responseHeaders, accept)
+		return
+	}
+	s.recordContentType(filePath, contentType)
+	
+	if existed {
+		sendResponse(conn, 200, "OK", "text/plain", []byte("File replaced"), responseHeaders, clientSupportsGzip, closeConn)
+		return
+	}
+	sendResponse(conn, 201, "Created", "text/plain", []byte("File created"), responseHeaders, clientSupportsGzip, closeConn)
+}
+
+// Send upload progress answers 308 for an unfinished upload. The Range header, left out
+// until the first byte has arrived, covers the bytes received from the start of the file.
+func (s *Server) sendUploadProgress(
+	conn net.Conn,
+	upload *resumableUpload,
+	responseHeaders Header,
+	clientSupportsGzip bool,
+	closeConn bool,
+) {
+	received := upload.receivedPrefix()
+	if received > 0 {
+		responseHeaders.Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	message := fmt.Sprintf("Received %d of %d bytes", received, upload.total)
+	sendResponse(conn, 308, "Permanent Redirect", "text/plain", []byte(message), responseHeaders, clientSupportsGzip, closeConn)
+}
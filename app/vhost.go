@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// Virtual host routes requests whose Host header names host to router instead of
+// the server's own routes, so several sites can share one port. Hosts are compared
+// case-insensitively and without their port. The router's middleware is its own;
+// none of the server's is applied to it.
+func (s *Server) VirtualHost(host string, router *Router) {
+	if s.virtualHosts == nil {
+		s.virtualHosts = make(map[string]*Router)
+	}
+	s.virtualHosts[hostName(host)] = router
+}
+
+// Virtual host proxy serves every request for host from an upstream server, keeping
+// the path as is, so with the upstream http://localhost:9000/site /about is fetched
+// from http://localhost:9000/site/about
+func (s *Server) virtualHostProxy(host string, upstreamURL string) error {
+	upstream, err := parseUpstream(upstreamURL)
+	if err != nil {
+		return err
+	}
+	router := NewRouter()
+	router.Use(s.securityHeaders)
+	router.Handle("", "/*", s.proxyHandler("", upstream))
+	s.VirtualHost(host, router)
+	return nil
+}
+
+// Router for returns the router for a request's Host header: the matching virtual
+// host's, or the server's own when no virtual host matches
+func (s *Server) routerFor(host string) *Router {
+	if router, ok := s.virtualHosts[hostName(host)]; ok {
+		return router
+	}
+	return s.router
+}
+
+// Host name lowercases a Host header value and drops its port and any trailing dot,
+// so "Example.COM.:8080" becomes "example.com"
+func hostName(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
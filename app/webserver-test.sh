@@ -6,6 +6,21 @@
 HOST=${1:-"localhost"}
 PORT=${2:-8080}
 BASE_URL="http://$HOST:$PORT"
+# Set TLS_PORT to also test an HTTPS instance started with --tls-cert and --tls-key
+TLS_URL=${TLS_PORT:+"https://$HOST:$TLS_PORT"}
+# Set RATE_LIMIT_PORT to also test an instance started with --rate-limit 2 --rate-burst 2
+RATE_LIMIT_URL=${RATE_LIMIT_PORT:+"http://$HOST:$RATE_LIMIT_PORT"}
+# Set FILES_DIR to the server's files directory (when it runs locally) to test symlink handling
+FILES_DIR=${FILES_DIR:-""}
+# Set ALT_PORT to also test an instance started with non-default settings:
+#   --no-directory-listing --cors-origin https://app.example.com --security-header 'X-Frame-Options: SAMEORIGIN' --cache-bytes 64
+#   --max-requests-per-conn 3 --max-delay 1s --sse-heartbeat 400ms --html-security-header 'Referrer-Policy: no-referrer'
+#   --idle-timeout 1s --static-cache-control 'public, max-age=3600' --immutable-assets --embedded-assets --max-request-line 200
+ALT_URL=${ALT_PORT:+"http://$HOST:$ALT_PORT"}
+# Set SERVER_BIN to the server binary to test environment configuration, bind addresses and graceful
+# shutdown on throwaway instances the script starts itself (on SHUTDOWN_PORT, default 8090)
+SERVER_BIN=${SERVER_BIN:-""}
+SHUTDOWN_PORT=${SHUTDOWN_PORT:-8090}
 
 # Colors for output
 GREEN='\033[0;32m'
@@ -68,6 +83,14 @@ run_test() {
   echo ""
 }
 
+# Function to send a raw request, for requests curl won't produce, optionally to another port
+raw_request() {
+  exec 3<>/dev/tcp/$HOST/${2:-$PORT}
+  printf "$1" >&3
+  timeout 2 cat <&3
+  exec 3<&-
+}
+
 echo "Starting tests for web server at $BASE_URL"
 echo "==========================================="
 
@@ -90,68 +113,200 @@ run_test "API status endpoint" "curl -s -i $BASE_URL/api/status" "200" "\"status
 # Test 5: API time endpoint
 run_test "API time endpoint" "curl -s -i $BASE_URL/api/time" "200" "\"time\":"
 
+# Test 5a: API status as plain text when Accept prefers it
+run_test "API status plain text" "curl -s -i $BASE_URL/api/status -H 'Accept: text/plain'" "200" "status: ok"
+
+# Test 5b: API time as plain text when Accept prefers it
+run_test "API time plain text" "curl -s -i $BASE_URL/api/time -H 'Accept: text/plain, application/json;q=0.5' | grep -c '^time: \|Content-Type: text/plain\|Vary: Accept'" "" "^3$"
+
+# Test 5c: API status as JSON when Accept asks for it
+run_test "API status JSON on request" "curl -s -i $BASE_URL/api/status -H 'Accept: application/json'" "200" "\"status\":\"ok\""
+
+# Test 5d: API time defaults to JSON for Accept: */*
+run_test "API time JSON for any type" "curl -s -i $BASE_URL/api/time -H 'Accept: */*' | grep -c 'Content-Type: application/json\|\"time\":'" "" "^2$"
+
 # Test 6: API echo endpoint
 run_test "API echo endpoint" "curl -s -i -X POST $BASE_URL/api/echo -d '{\"test\":\"data\"}' -H 'Content-Type: application/json'" "200" "\"test\":\"data\""
 
+# Test 7: API echo rejects invalid JSON
+run_test "API echo invalid JSON" "curl -s -i -X POST $BASE_URL/api/echo -d 'not json' -H 'Content-Type: application/json'" "400" "invalid JSON"
+
+# Test 8: Truncated JSON is rejected too
+run_test "API echo truncated JSON" "curl -s -i -X POST $BASE_URL/api/echo -d '{\"test\":' -H 'Content-Type: application/json'" "400" "invalid JSON"
+
+# Test 9: Only a single JSON value is accepted
+run_test "API echo trailing data" "curl -s -i -X POST $BASE_URL/api/echo -d '{\"test\":1} {}' -H 'Content-Type: application/json'" "400" "unexpected data after the value"
+
+# Test 9a: API echo returns form fields with every value of a repeated one
+run_test "API echo form body" "curl -s -i -X POST $BASE_URL/api/echo -d 'a=1&a=2&b=3'" "200" '\{"a":\["1","2"\],"b":\["3"\]}'
+
+# Test 9b: API echo decodes escapes in form fields
+run_test "API echo form escapes" "curl -s -i -X POST $BASE_URL/api/echo -H 'Content-Type: application/x-www-form-urlencoded; charset=utf-8' --data-binary 'name=J%C3%BCrgen+M&empty='" "200" '\{"empty":\[""\],"name":\["Jürgen M"\]}'
+
+# Test 9c: A malformed form body is rejected
+run_test "API echo malformed form" "curl -s -i -X POST $BASE_URL/api/echo -d 'a=%zz'" "400" "invalid form body"
+
+# Test 10: An empty body is not JSON
+run_test "API echo empty body" "curl -s -i -X POST $BASE_URL/api/echo -H 'Content-Type: application/json' -H 'Content-Length: 0'" "400" "empty request body"
+
+# Test 11: JSON bodies are capped at 1 MiB
+run_test "API echo JSON too large" "head -c 1100000 /dev/zero | tr '\\0' 1 | curl -s -i -X POST $BASE_URL/api/echo -H 'Content-Type: application/json' -H 'Expect:' --data-binary @-" "413" "JSON body too large"
+
+# Test 12: Anything endpoint reflects method, path and query, keeping repeated parameters
+run_test "API anything request line" "curl -s -i -X POST '$BASE_URL/api/anything/sub?tag=a&tag=b' -d 'hello'" "200" "\"method\":\"POST\",\"path\":\"/api/anything/sub\",\"query\":\{\"tag\":\[\"a\",\"b\"\]\}"
+
+# Test 13: Anything endpoint reflects headers, keeping repeated ones apart, and the body
+run_test "API anything headers and body" "curl -s -i -X PUT $BASE_URL/api/anything -H 'X-Test: one' -H 'X-Test: two' -d 'hello'" "200" "\"X-Test\":\[\"one\",\"two\"\].*\"body\":\"hello\""
+
+# Test 16: Cookies endpoint lists the cookies sent, unquoted
+run_test "API cookies" "curl -s -i $BASE_URL/api/cookies -H 'Cookie: theme=dark; lang=\"en\"'" "200" '\{"lang":"en","theme":"dark"\}'
+
+# Test 17: Delay endpoint waits before answering
+run_test "API delay" "curl -s -i -w ' %{time_total}' $BASE_URL/api/delay/0.3" "200" "\"capped\":false,\"delay\":0.3\} 0\.[3-9]"
+
+# Test 18: Delay must be a number
+run_test "API delay invalid" "curl -s -i $BASE_URL/api/delay/soon" "400" "non-negative number"
+
+# Test 19: Status endpoint answers with the requested code and its text
+run_test "API status code" "curl -s -i $BASE_URL/api/status/418" "418" "I'm a teapot"
+
+# Test 20: Codes outside 100-599 are rejected
+run_test "API status code out of range" "curl -s -i $BASE_URL/api/status/600" "400" "from 100 to 599"
+
+# Test 21: Non-numeric codes are rejected
+run_test "API status code not a number" "curl -s -i $BASE_URL/api/status/teapot" "400" "from 100 to 599"
+
 # File operations tests
 echo -e "${BLUE}File Operations Tests${NC}"
 echo "-------------------------------------------"
 
-# Test 7: Create a test file
+# Test 22: Create a test file
 run_test "Create file" "curl -s -i -X POST $BASE_URL/files/test.txt -d 'This is a test file'" "201" "File created"
 
-# Test 8: Get the created file
+# Test 23: Get the created file
 run_test "Get file" "curl -s -i $BASE_URL/files/test.txt" "200" "This is a test file"
 
-# Test 9: Delete the test file
+# Test 24: Delete the test file
 run_test "Delete file" "curl -s -i -X DELETE $BASE_URL/files/test.txt" "200" "File deleted"
 
-# Test 10: Try to get non-existent file
+# Test 25: Try to get non-existent file
 run_test "Get non-existent file" "curl -s -i $BASE_URL/files/nonexistent.txt" "404" "File not found"
 
 # Security tests
 echo -e "${BLUE}Security Tests${NC}"
 echo "-------------------------------------------"
 
-# Test 11: Path traversal attempt
+# Test 26: Path traversal attempt
 #run_test "Path traversal attempt" "curl -s -i $BASE_URL/files/../../../etc/passwd" "403" "Path traversal not allowed"
 
-# Test 12: Another path traversal variant
-run_test "Path traversal variant" "curl -s -i $BASE_URL/files/%2e%2e/%2e%2e/etc/passwd" "403" "Path traversal not allowed"
+# Test 26a: Encoded dot segments resolve above /files and never reach the filesystem
+run_test "Path traversal variant" "curl -s -i $BASE_URL/files/%2e%2e/%2e%2e/etc/passwd" "404" "Not Found"
+
+# Test 28: Sibling directory sharing the files prefix
+run_test "Sibling directory traversal" "curl -s -i --path-as-is $BASE_URL/files/..%2ffiles-secret/key" "403" "Path traversal not allowed"
+
+# Test 28a: Duplicate slashes are collapsed before routing
+run_test "Duplicate slashes" "curl -s -i --path-as-is '$BASE_URL//echo//foo'" "200" "Content-Length: 3"
+
+# Test 28b: Dot segments are resolved before routing
+run_test "Dot segment" "curl -s -i --path-as-is $BASE_URL/./echo/./bar" "200" "Content-Length: 3"
+
+# Test 28c: Dot-dot resolves within the path
+run_test "Dot-dot segment" "curl -s -i --path-as-is $BASE_URL/echo/skip/../baz" "200" "Content-Length: 3"
+
+# Test 28d: Encoded dot-dot resolves like a plain one
+run_test "Encoded dot-dot segment" "curl -s -i --path-as-is $BASE_URL/echo/skip/%2E%2e/qux" "200" "Content-Length: 3"
+
+# Test 28e: Dot-dot can't climb above the root
+run_test "Dot-dot above root" "curl -s -i --path-as-is $BASE_URL/../../echo/top" "200" "Content-Length: 3"
+
+# Test 28f: Dot-dot out of /files routes elsewhere rather than escaping it
+run_test "Dot-dot out of files" "curl -s -i --path-as-is $BASE_URL/files/../user-agent -H 'User-Agent: normalized'" "200" "normalized"
+
+# Test 28g: Normalized paths under /files still reach the file
+curl -s -o /dev/null -X PUT $BASE_URL/files/normalized.txt -d 'normalized file'
+run_test "Normalized files path" "curl -s -i --path-as-is $BASE_URL/./files//sub/../normalized.txt" "200" "normalized file"
+curl -s -o /dev/null -X DELETE $BASE_URL/files/normalized.txt
+
+# Test 29: Encoded traversal with ..%2f
+run_test "Encoded slash traversal" "curl -s -i --path-as-is $BASE_URL/files/..%2f..%2fetc%2fpasswd" "403" "Path traversal not allowed"
+
+# Test 30: Dotfiles are hidden
+run_test "Dotfile hidden" "curl -s -i $BASE_URL/files/.env" "404" "File not found"
+
+# Test 31: Nested dot segments are hidden
+run_test "Nested dot segment hidden" "curl -s -i $BASE_URL/files/.git/config" "404" "File not found"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/safe/nested.txt -d 'nested content'
+
+# Test 32: Legitimate nested file
+run_test "Legitimate nested file" "curl -s -i $BASE_URL/files/safe/nested.txt" "200" "nested content"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/safe/nested.txt
+curl -s -o /dev/null -X DELETE $BASE_URL/files/safe
+
+if [[ -n "$FILES_DIR" ]]; then
+  ln -s /etc "$FILES_DIR/escape"
+  
+  # Test 33: Reading through a symlink that leaves the files directory
+  run_test "Symlink escape read" "curl -s -i $BASE_URL/files/escape/hostname" "403" "Path traversal not allowed"
+  
+  # Test 34: Writing through a symlink that leaves the files directory
+  run_test "Symlink escape write" "curl -s -i -X POST $BASE_URL/files/escape/planted.txt -d 'planted'" "403" "Path traversal not allowed"
+  
+  rm -f "$FILES_DIR/escape"
+fi
 
 # Session tests
 echo -e "${BLUE}Session Tests${NC}"
 echo "-------------------------------------------"
 
-# Test 13: Test API session endpoint
+# Test 35: Test API session endpoint
 run_test "API session endpoint" "curl -s -i $BASE_URL/api/session -c cookies.txt" "200" "\"session_id\":"
 
-# Test 14: Test session persistence
+# Test 36: Test session persistence
 run_test "Session persistence" "curl -s -i $BASE_URL/api/session -b cookies.txt" "200" "\"session_id\":"
 
+session_id=$(grep -o 'session[[:space:]][0-9a-f]*' cookies.txt | awk '{print $2}')
+
+# Test 37: The session is found when cookies arrive in separate Cookie headers
+run_test "Session in second Cookie header" "curl -s -i $BASE_URL/api/session -H 'Cookie: theme=dark' -H 'Cookie: session=$session_id' | grep -o 'Set-Cookie\|\"session_id\":\"[^\"]*\"'" "" "^\"session_id\":\"$session_id\"$"
+
+# Test 38: Quoted cookie values are unquoted
+run_test "Quoted session cookie" "curl -s -i $BASE_URL/api/session -H 'Cookie: session=\"$session_id\"' | grep -o 'Set-Cookie\|\"session_id\":\"[^\"]*\"'" "" "^\"session_id\":\"$session_id\"$"
+
 # Performance and feature tests
 echo -e "${BLUE}Performance and Feature Tests${NC}"
 echo "-------------------------------------------"
 
-# Test 15: Gzip encoding
+# Test 39: Gzip encoding
 run_test "Gzip encoding" "curl -s -i $BASE_URL/ --compressed -H 'Accept-Encoding: gzip'" "200" "Content-Encoding: gzip"
 
-# Test 16: Directory listing
+# Test 40: Directory listing
 run_test "Directory listing" "curl -s -i $BASE_URL/files/" "200" "Directory Listing"
 
-# Test 17: Method not allowed
-#run_test "Method not allowed" "curl -s -i -X PUT $BASE_URL/user-agent" "404" "Not Found"
+# Test 41: Method not allowed
+run_test "Method not allowed" "curl -s -i -X PUT $BASE_URL/user-agent" "405" "Allow: GET"
 
-# Test 18: Large request body
+# Test 42: Large request body
 run_test "Large request body" "dd if=/dev/zero bs=1024 count=100 2>/dev/null | curl -s -i -X POST $BASE_URL/files/large.bin --data-binary @-" "201" "File created"
 
-# Test 19: Clean up large file
+# Test 43: Clean up large file
 run_test "Delete large file" "curl -s -i -X DELETE $BASE_URL/files/large.bin" "200" "File deleted"
 
-# Test 20: Security headers
+# Test 44: Security headers
 run_test "Security headers" "curl -s -i $BASE_URL/" "200" "X-Content-Type-Options: nosniff"
 
-# Test 21: Multiple concurrent requests
+# Test 45: Deprecated X-XSS-Protection is not sent by default
+run_test "No X-XSS-Protection by default" "curl -s -i $BASE_URL/ | grep -ci X-XSS-Protection || true" "" "^0$"
+
+# Test 46: HTML responses get the HTML-only security headers
+run_test "HTML security headers" "curl -s -i $BASE_URL/files/" "200" "X-Frame-Options: DENY"
+
+# Test 47: JSON responses keep nosniff but leave out the HTML-only headers
+run_test "JSON omits HTML-only headers" "curl -s -i $BASE_URL/api/status | grep -ci 'X-Frame-Options\|X-Content-Type-Options: nosniff'" "" "^1$"
+
+# Test 48: Multiple concurrent requests
 echo -e "${YELLOW}Running multiple concurrent requests...${NC}"
 for i in {1..10}; do
   curl -s $BASE_URL/ &>/dev/null &
@@ -160,18 +315,1122 @@ wait
 echo -e "${GREEN}Concurrent requests completed${NC}"
 echo ""
 
-# Test 22: Very long URL
+# Test 49: Very long URL
 long_url=$(printf "%0.s$" {1..500})
 run_test "Very long URL" "curl -s -i \"$BASE_URL/echo/$long_url\"" "200"
 
-# Test 23: Long header
+# Test 50: Long header
 run_test "Long header" "curl -s -i $BASE_URL/ -H \"X-Custom-Header: $(printf '%0.s$' {1..500})\"" "200" "Welcome to the Go Web Server"
 
-# Test 24: Non-existent path
+# Test 51: Non-existent path
 run_test "Non-existent path" "curl -s -i $BASE_URL/notfound" "404" "Not Found"
 
-# Test 25: Verify files endpoint methods
-run_test "PUT method not allowed" "curl -s -i -X PUT $BASE_URL/files/test.txt -d 'content'" "405" "Method not allowed"
+# Test 52: Verify files endpoint methods
+run_test "TRACE method not allowed" "curl -s -i -X TRACE $BASE_URL/files/test.txt" "405" "Method not allowed"
+
+# Test 52a: TRACE is rejected at the root
+run_test "TRACE rejected at root" "curl -s -i -X TRACE $BASE_URL/" "405" "Allow: DELETE, GET, OPTIONS, PATCH, POST, PUT"
+
+# Test 52b: TRACE is rejected on echo rather than reflected
+run_test "TRACE rejected on echo" "curl -s -i -X TRACE $BASE_URL/echo/x -H 'Cookie: session=secret'" "405" "Allow: DELETE, GET, OPTIONS, PATCH, POST, PUT"
+
+# Test 52c: TRACE lists the methods a GET-only route accepts
+run_test "TRACE rejected on GET-only route" "curl -s -i -X TRACE $BASE_URL/user-agent" "405" "Allow: GET"
+
+# Test 52d: TRACE is rejected on unknown paths and probes too
+run_test "TRACE rejected everywhere" "for p in /missing /healthz /metrics /api/anything; do curl -s -o /dev/null -w '%{http_code} ' -X TRACE $BASE_URL\$p; done" "" "^405 405 405 405 $"
+
+# Test 53: The files 405 lists the supported methods
+run_test "Files Allow header" "curl -s -i -X TRACE $BASE_URL/files/test.txt" "405" "Allow: DELETE, GET, PATCH, POST, PUT"
+
+# Test 54: The files root supports fewer methods
+run_test "Files root Allow header" "curl -s -i -X PUT $BASE_URL/files" "405" "Allow: DELETE, GET, POST"$'\r'
+
+# Test 54a: TRACE on the files root lists the root's methods
+run_test "Files root TRACE Allow header" "curl -s -i -X TRACE $BASE_URL/files/" "405" "Allow: DELETE, GET, POST"$'\r'
+
+# Test 54b: Methods the files handler doesn't know get the same Allow header as TRACE
+run_test "Files OPTIONS Allow header" "curl -s -i -X OPTIONS $BASE_URL/files/test.txt" "405" "Allow: DELETE, GET, PATCH, POST, PUT"$'\r'
+
+# Test 54c: A POST to the files root must be a form upload
+run_test "Files root non-multipart POST" "curl -s -i -X POST $BASE_URL/files -d 'data'" "415" "multipart/form-data"
+
+# Routing tests
+echo -e "${BLUE}Routing Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 55: Method mismatch lists the allowed methods
+run_test "API echo rejects GET" "curl -s -i $BASE_URL/api/echo" "405" "Allow: POST, PUT"
+
+# Test 56: Prefix routes match nested paths
+run_test "Echo nested path" "curl -s -i $BASE_URL/echo/a/b" "200" "a/b"
+
+# Test 57: Middleware applies to unmatched routes too
+run_test "Security headers on not found" "curl -s -i $BASE_URL/notfound" "404" "X-Content-Type-Options: nosniff"
+
+# Error response tests
+echo -e "${BLUE}Error Response Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 58: Errors are plain text by default
+run_test "Error as plain text" "curl -s -i $BASE_URL/notfound" "404" "Content-Type: text/plain.*Not Found$"
+
+# Test 59: Clients that accept anything still get plain text
+run_test "Error with wildcard Accept" "curl -s -i $BASE_URL/notfound -H 'Accept: */*'" "404" "Content-Type: text/plain"
+
+# Test 60: JSON clients get the status and message as JSON
+run_test "Error as JSON" "curl -s -i $BASE_URL/notfound -H 'Accept: application/json'" "404" 'Content-Type: application/json.*\{"error":"Not Found","status":404\}'
+
+# Test 61: Handler errors carry their own message
+run_test "File error as JSON" "curl -s -i $BASE_URL/files/missing.txt -H 'Accept: application/json'" "404" '\{"error":"File not found","status":404\}'
+
+# Test 62: A 405 keeps its Allow header in JSON form
+run_test "Method error as JSON" "curl -s -i $BASE_URL/api/echo -H 'Accept: text/html;q=0.5, application/json'" "405" 'Allow: POST, PUT.*"status":405'
+
+# Test 62a: A 400 from a handler is JSON for JSON clients
+run_test "Bad request as JSON" "curl -s -i $BASE_URL/api/status/teapot -H 'Accept: application/json'" "400" '\{"error":"Status code must be a number from 100 to 599","status":400\}'
+
+# Test 62b: A 403 is JSON for JSON clients
+run_test "Forbidden as JSON" "curl -s -i --path-as-is $BASE_URL/files/..%2fetc%2fpasswd -H 'Accept: application/json'" "403" '\{"error":"Path traversal not allowed","status":403\}'
+
+
+# Request line tests
+echo -e "${BLUE}Request Line Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 63: Request line without an HTTP version
+run_test "Missing HTTP version" "raw_request 'GET /\r\n\r\n'" "400" "Bad Request"
+
+# Test 64: Request line with a malformed HTTP version
+run_test "Bogus HTTP version" "raw_request 'GET / HTTP/one\r\n\r\n'" "400" "Bad Request"
+
+# Test 65: Request line with an unsupported HTTP version
+run_test "Unsupported HTTP version" "raw_request 'GET / HTTP/2.0\r\n\r\n'" "505" "HTTP Version Not Supported"
+
+# Test 65a: A request line over the default 8192-byte cap gets a 414 and the connection closes
+long_path=$(printf 'a%.0s' {1..9000})
+run_test "Request line too long" "curl -s -i $BASE_URL/echo/$long_path" "414" "Connection: close.*URI Too Long"
+
+# Test 65b: A long request line within the cap is served
+within_path=$(printf 'a%.0s' {1..8000})
+run_test "Long request line within cap" "curl -s -i $BASE_URL/echo/$within_path" "200" "Content-Length: 8000"
+
+# Test 66: Garbage request line
+run_test "Garbage request line" "raw_request 'hello there\r\n\r\n'" "400" "Bad Request"
+
+# Test 67: HTTP/1.0 closes the connection by default
+run_test "HTTP/1.0 default close" "curl -s -i --http1.0 $BASE_URL/" "200" "HTTP/1.0 200 OK.*Connection: close"
+
+# Test 68: HTTP/1.0 stays open when the client asks for keep-alive
+run_test "HTTP/1.0 keep-alive" "curl -s -i --http1.0 -H 'Connection: keep-alive' $BASE_URL/" "200" "Connection: keep-alive"
+
+# Test 69: Persistent HTTP/1.1 responses announce keep-alive and the idle timeout
+run_test "HTTP/1.1 Keep-Alive header" "curl -s -i $BASE_URL/ | grep -i '^Connection:\|^Keep-Alive:' | tr -d '\r' | sort | tr '\n' ' '" "" "^Connection: keep-alive Keep-Alive: timeout=60 $"
+
+# Test 70: A response that closes the connection has no Keep-Alive header
+run_test "No Keep-Alive on close" "curl -s -i -H 'Connection: close' $BASE_URL/ | grep -ci '^Keep-Alive:' || true" "" "^0$"
+
+# Test 71: Upload that waits for 100 Continue
+run_test "Expect 100-continue" "curl -s -i -X POST -H 'Expect: 100-continue' $BASE_URL/files/expect.txt -d 'expected'" "" "100 Continue.*201 Created"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/expect.txt
+
+# Test 72: Unknown expectation
+run_test "Expect unknown" "curl -s -i -X POST -H 'Expect: teapot' $BASE_URL/files/expect.txt -d 'expected'" "417" "Expectation Failed"
+
+# Pipelining and request body framing tests
+echo -e "${BLUE}Pipelining Tests${NC}"
+echo "-------------------------------------------"
+
+pipelined_posts='POST /api/echo HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nContent-Length: 11\r\n\r\n{"first":1}'
+pipelined_posts+='POST /api/echo HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n6\r\n{"seco\r\n6\r\nnd":2}\r\n0\r\n\r\n'
+pipelined_posts+='GET /echo/third HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n'
+
+# Test 73: Pipelined POSTs each get their own body, including a chunked one
+run_test "Pipelined POST bodies" "raw_request '$pipelined_posts' | tr -d '\r' | grep -o '^{\"[a-z]*\":[0-9]}\|third$' | tr '\n' ' '" "" "^\{\"first\":1\} \{\"second\":2\} third $"
+
+# Test 74: A chunked body's trailer fields are skipped
+run_test "Chunked body with trailer" "raw_request 'POST /api/echo HTTP/1.1\r\nHost: localhost\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n2\r\n{}\r\n0\r\nX-Checksum: none\r\n\r\nGET /echo/after HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n' | grep -o 'HTTP/1.1 200\|after$' | tr '\n' ' '" "" "^HTTP/1.1 200 HTTP/1.1 200 after $"
+
+# Test 75: Unsupported transfer codings are refused
+run_test "Unsupported transfer coding" "raw_request 'POST /api/echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n'" "501" "Not Implemented"
+
+# Caching tests
+echo -e "${BLUE}Caching Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/cache.txt -d 'cache me'
+etag=$(curl -s -D - -o /dev/null $BASE_URL/files/cache.txt | grep -i '^ETag:' | cut -d' ' -f2 | tr -d '\r')
+
+# Test 76: Matching If-None-Match
+run_test "Matching If-None-Match" "curl -s -i $BASE_URL/files/cache.txt -H 'If-None-Match: $etag'" "304" "ETag: \"[0-9a-f]+-[0-9a-f]+\""
+
+# Test 77: Non-matching If-None-Match
+run_test "Non-matching If-None-Match" "curl -s -i $BASE_URL/files/cache.txt -H 'If-None-Match: \"stale\"'" "200" "cache me"
+
+# Test 78: Fresh If-Modified-Since
+run_test "Fresh If-Modified-Since" "curl -s -i $BASE_URL/files/cache.txt -H 'If-Modified-Since: $(date -u -d '+1 hour' '+%a, %d %b %Y %H:%M:%S GMT')'" "304" "Last-Modified:"
+
+# Test 79: Stale If-Modified-Since
+run_test "Stale If-Modified-Since" "curl -s -i $BASE_URL/files/cache.txt -H 'If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT'" "200" "cache me"
+
+# Test 80: A byte range is served as 206 Partial Content
+run_test "Range request" "curl -s -i $BASE_URL/files/cache.txt -H 'Range: bytes=0-4'" "206" "Content-Range: bytes 0-4/8.*Content-Length: 5.*cache\$"
+
+# Test 81: A suffix range is served from the end
+run_test "Suffix range request" "curl -s -i $BASE_URL/files/cache.txt -H 'Range: bytes=-2'" "206" "Content-Range: bytes 6-7/8.*me$"
+
+# Test 82: A range past the end is 416
+run_test "Unsatisfiable range" "curl -s -i $BASE_URL/files/cache.txt -H 'Range: bytes=100-'" "416" "Content-Range: bytes \*/8"
+
+# Test 83: If-Range with a stale ETag gets the whole file
+run_test "Stale If-Range" "curl -s -i $BASE_URL/files/cache.txt -H 'Range: bytes=0-4' -H 'If-Range: \"stale\"'" "200" "cache me"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/cache.txt
+
+# Embedded asset tests
+echo -e "${BLUE}Embedded Asset Tests${NC}"
+echo "-------------------------------------------"
+
+if [[ -n "$ALT_URL" ]]; then
+  # Test 84: Files compiled into the binary are served under /static
+  run_test "Embedded asset" "curl -s -i $ALT_URL/static/style.css" "200" "Content-Type: text/css.*font-family: sans-serif"
+  
+  # Test 85: The mount's root serves its index.html
+  run_test "Embedded index page" "curl -s -i $ALT_URL/static/" "200" "Content-Type: text/html.*These assets are compiled into the server binary"
+  
+  static_etag=$(curl -s -D - -o /dev/null $ALT_URL/static/style.css | grep -i '^ETag:' | cut -d' ' -f2 | tr -d '\r')
+  
+  # Test 86: Embedded assets revalidate by ETag
+  run_test "Embedded asset If-None-Match" "curl -s -i $ALT_URL/static/style.css -H 'If-None-Match: $static_etag'" "304" "ETag: \"[0-9a-f]+\""
+  
+  # Test 87: Embedded assets support ranges
+  run_test "Embedded asset range" "curl -s -i $ALT_URL/static/style.css -H 'Range: bytes=0-3'" "206" "Content-Range: bytes 0-3/[0-9]+.*body$"
+  
+  # Test 88: The mount is read-only
+  run_test "Embedded asset read-only" "curl -s -i -X DELETE $ALT_URL/static/style.css" "405" "Allow: GET"
+  
+  # Test 89: Missing embedded files are 404
+  run_test "Embedded asset missing" "curl -s -i $ALT_URL/static/missing.css" "404" "File not found"
+fi
+
+# Test 89a: /static is only mounted when embedded assets are enabled
+run_test "Embedded assets off by default" "curl -s -i $BASE_URL/static/style.css" "404" "Not Found"
+
+# Conditional write tests
+echo -e "${BLUE}Conditional Write Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X PUT $BASE_URL/files/cond.txt -d 'version 1'
+cond_etag=$(curl -s -D - -o /dev/null $BASE_URL/files/cond.txt | grep -i '^ETag:' | cut -d' ' -f2 | tr -d '\r')
+
+# Test 90: PUT with a matching If-Match replaces the file
+run_test "If-Match matching" "curl -s -i -X PUT $BASE_URL/files/cond.txt -H 'If-Match: $cond_etag' -d 'version 2'" "200" "File replaced"
+
+# Test 91: PUT with a stale If-Match is rejected
+run_test "If-Match mismatching" "curl -s -i -X PUT $BASE_URL/files/cond.txt -H 'If-Match: $cond_etag' -d 'version 3'" "412" "Precondition failed"
+
+# Test 92: Rejected write leaves the file alone
+run_test "If-Match rejection keeps content" "curl -s $BASE_URL/files/cond.txt" "" "^version 2$"
+
+# Test 93: Create-only PUT on an existing file
+run_test "If-None-Match star existing" "curl -s -i -X PUT $BASE_URL/files/cond.txt -H 'If-None-Match: *' -d 'clobber'" "412" "Precondition failed"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/cond.txt
+
+# Test 94: Create-only PUT on a new file
+run_test "If-None-Match star new" "curl -s -i -X PUT $BASE_URL/files/cond.txt -H 'If-None-Match: *' -d 'fresh'" "201" "File created"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/cond.txt
+
+# Test 95: Session IDs are 128-bit hex strings
+run_test "Session ID format" "curl -s -i $BASE_URL/" "200" "session=[0-9a-f]{32};"
+
+# Probe tests
+echo -e "${BLUE}Probe Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 96: Liveness probe
+run_test "Liveness probe" "curl -s -i $BASE_URL/healthz" "200" "ok"
+
+# Test 97: Readiness probe once started
+run_test "Readiness probe" "curl -s -i $BASE_URL/readyz" "200" "ok"
+
+# Test 98: Probes don't create sessions
+run_test "Probes skip sessions" "curl -s -i $BASE_URL/healthz | grep -ci Set-Cookie || true" "" "^0$"
+
+# Test 99: Probes skip the middleware stack
+run_test "Probes skip middleware" "curl -s -i $BASE_URL/healthz | grep -ci X-Frame-Options || true" "" "^0$"
+
+# Metrics tests
+echo -e "${BLUE}Metrics Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 100: Request counter
+run_test "Metrics request counter" "curl -s -i $BASE_URL/metrics" "200" "http_requests_total [0-9]+"
+
+# Test 101: Status class counters
+run_test "Metrics status classes" "curl -s $BASE_URL/metrics" "" "http_responses_total\{code=\"4xx\"\} [1-9]"
+
+# Test 102: Duration histogram
+run_test "Metrics duration histogram" "curl -s $BASE_URL/metrics" "" "http_request_duration_seconds_bucket\{le=\"\+Inf\"\} [0-9]+"
+
+# Test 103: Active connections gauge includes the scrape itself
+run_test "Metrics active connections" "curl -s $BASE_URL/metrics" "" "http_active_connections [1-9]"
+
+requests_before=$(curl -s $BASE_URL/metrics | awk '/^http_requests_total /{print $2}')
+for i in 1 2 3; do curl -s -o /dev/null $BASE_URL/; done
+requests_after=$(curl -s $BASE_URL/metrics | awk '/^http_requests_total /{print $2}')
+
+# Test 104: Request counter reflects the requests made between scrapes
+run_test "Metrics count requests" "echo $((requests_after - requests_before))" "" "^3$"
+
+# Request ID tests
+echo -e "${BLUE}Request ID Tests${NC}"
+echo "-------------------------------------------"
+
+# Test 105: Generated request ID
+run_test "Generated request ID" "curl -s -i $BASE_URL/" "200" "X-Request-ID: [0-9a-f]{32}"
+
+# Test 106: Supplied request ID is echoed
+run_test "Supplied request ID" "curl -s -i $BASE_URL/ -H 'X-Request-ID: trace-abc.123'" "200" "X-Request-ID: trace-abc.123"
+
+# Content type tests
+echo -e "${BLUE}Content Type Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/style.css -d 'body { color: red; }'
+curl -s -o /dev/null -X POST $BASE_URL/files/script.js -d 'console.log(1);'
+printf '\x89PNG\r\n\x1a\n' | curl -s -o /dev/null -X POST $BASE_URL/files/image.png --data-binary @-
+curl -s -o /dev/null -X POST $BASE_URL/files/README -d 'plain text without an extension'
+
+# Test 107: CSS content type
+run_test "CSS content type" "curl -s -i $BASE_URL/files/style.css" "200" "Content-Type: text/css"
+
+# Test 108: JavaScript content type
+run_test "JavaScript content type" "curl -s -i $BASE_URL/files/script.js" "200" "Content-Type: (text|application)/javascript"
+
+# Test 109: PNG content type
+run_test "PNG content type" "curl -s -i $BASE_URL/files/image.png --output -" "200" "Content-Type: image/png"
+
+# Test 110: Sniffed content type for extensionless file
+run_test "Extensionless text content type" "curl -s -i $BASE_URL/files/README" "200" "Content-Type: text/plain; charset=utf-8"
+
+for f in style.css script.js image.png README; do
+  curl -s -o /dev/null -X DELETE $BASE_URL/files/$f
+done
+
+# Directory listing tests
+echo -e "${BLUE}Directory Listing Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/listed.txt -d 'listed'
+
+# Test 111: JSON directory listing
+run_test "JSON directory listing" "curl -s -i $BASE_URL/files/ -H 'Accept: application/json'" "200" "\{\"name\":\"listed.txt\",\"size\":6,\"is_dir\":false,\"modified\":\"[^\"]+\"\}"
+
+# Test 112: HTML directory listing by default
+run_test "HTML directory listing" "curl -s -i $BASE_URL/files/ -H 'Accept: text/html,*/*;q=0.8'" "200" "Content-Type: text/html"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/listed.txt
+
+curl -s -o /dev/null -X POST $BASE_URL/files/nested/inner/deep.txt -d 'deep'
+
+# Test 113: Nested directory listing
+run_test "Nested directory listing" "curl -s -i $BASE_URL/files/nested/inner/" "200" "<a href=\"/files/nested/inner/deep.txt\">deep.txt</a>"
+
+# Test 114: Parent link stays within the files root
+run_test "Directory listing parent link" "curl -s -i $BASE_URL/files/nested/" "200" "<a href=\"/files/\">..</a>"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/nested/inner/deep.txt
+curl -s -o /dev/null -X DELETE $BASE_URL/files/nested/inner
+curl -s -o /dev/null -X DELETE $BASE_URL/files/nested
+
+curl -s -o /dev/null -X POST "$BASE_URL/files/a%22%3Cb%3E%20c.txt" -d 'markup'
+
+# Test 115: Listing escapes markup in file names and encodes their links
+run_test "Directory listing escapes names" "curl -s -i $BASE_URL/files/" "200" "<a href=\"/files/a%22%3Cb%3E%20c.txt\">a&#34;&lt;b&gt; c.txt</a>"
+
+# Test 116: Escaped link resolves to the file
+run_test "Escaped listing link" "curl -s -i '$BASE_URL/files/a%22%3Cb%3E%20c.txt'" "200" "markup"
+
+curl -s -o /dev/null -X DELETE "$BASE_URL/files/a%22%3Cb%3E%20c.txt"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/site/index.html -d '<h1>Site index</h1>'
+curl -s -o /dev/null -X POST $BASE_URL/files/site/plain/page.txt -d 'page'
+
+# Test 117: Directory with an index file serves it
+run_test "Directory index file" "curl -s -i $BASE_URL/files/site/" "200" "Content-Type: text/html.*<h1>Site index</h1>"
+
+# Test 118: Directory without an index file is listed
+run_test "Directory without index file" "curl -s -i $BASE_URL/files/site/plain/" "200" "Directory Listing"
+
+curl -s -o /dev/null -X DELETE "$BASE_URL/files/site?recursive=1"
+
+# Upload tests
+echo -e "${BLUE}Upload Tests${NC}"
+echo "-------------------------------------------"
+
+upload_file=$(mktemp)
+echo 'first file' > "$upload_file"
+
+# Test 119: Multipart upload of two files
+run_test "Multipart upload" "curl -s -i $BASE_URL/files/ -F 'first=@$upload_file;filename=first.txt' -F 'second=@$upload_file;filename=../second.txt'" "201" "\"files\":\[\{\"name\":\"first.txt\",\"size\":11\},\{\"name\":\"second.txt\",\"size\":11\}\]"
+
+# Test 120: Uploaded files land on disk
+run_test "Multipart upload stored" "curl -s -i $BASE_URL/files/first.txt" "200" "first file"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/first.txt
+curl -s -o /dev/null -X DELETE $BASE_URL/files/second.txt
+rm -f "$upload_file"
+
+# Test 121: PUT creates a new file
+run_test "PUT creates file" "curl -s -i -X PUT $BASE_URL/files/put.txt -d 'version 1'" "201" "File created"
+
+# Test 122: PUT replaces an existing file
+run_test "PUT replaces file" "curl -s -i -X PUT $BASE_URL/files/put.txt -d 'version 2'" "200" "File replaced"
+
+# Test 123: Replaced content is served
+run_test "PUT replaced content" "curl -s -i $BASE_URL/files/put.txt" "200" "version 2"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/put.txt
+
+# Test 123a: First piece of a resumable upload reports the bytes received
+run_test "Resumable upload first range" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 0-4/11' --data-binary 'hello'" "308" "Range: bytes=0-4"
+
+# Test 123b: Unfinished upload is not served yet
+run_test "Resumable upload incomplete" "curl -s -i $BASE_URL/files/resume.txt" "404" ""
+
+# Test 123c: A range overlapping received bytes is rejected
+run_test "Resumable upload overlap" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 3-6/11' --data-binary 'lo w'" "409" "overlaps"
+
+# Test 123d: A range past the total size is rejected
+run_test "Resumable upload past total" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 6-11/11' --data-binary 'world!'" "416" "Content-Range: bytes \*/11"
+
+# Test 123e: A body that doesn't match its range is rejected
+run_test "Resumable upload length mismatch" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 5-10/11' --data-binary 'wor'" "400" "does not match"
+
+# Test 123f: Empty range query reports progress for resuming
+run_test "Resumable upload progress" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes */11'" "308" "Range: bytes=0-4"
+
+# Test 123g: Last piece completes the upload
+run_test "Resumable upload last range" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 5-10/11' --data-binary ' world'" "201" "File created"
+
+# Test 123h: Pieces are assembled in order
+run_test "Resumable upload content" "curl -s $BASE_URL/files/resume.txt" "" "^hello world$"
+
+# Test 123i: Pieces sent out of order are assembled too
+curl -s -o /dev/null -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 6-10/11' --data-binary 'there'
+curl -s -o /dev/null -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes 0-5/11' --data-binary 'howdy '
+run_test "Resumable upload out of order" "curl -s $BASE_URL/files/resume.txt" "" "^howdy there$"
+
+# Test 123j: Malformed Content-Range is rejected
+run_test "Resumable upload bad range" "curl -s -i -X PUT $BASE_URL/files/resume.txt -H 'Content-Range: bytes -1-4/11' --data-binary 'hello'" "400" "Invalid Content-Range"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/resume.txt
+
+# Test 45a: POST creates a new file
+run_test "POST creates file" "curl -s -i -X POST $BASE_URL/files/post.txt -d 'original'" "201" "File created"
+
+# Test 45b: POST to an existing file conflicts
+run_test "POST existing file conflicts" "curl -s -i -X POST $BASE_URL/files/post.txt -d 'overwrite'" "409" "File already exists"
+
+# Test 45c: Conflicting POST leaves the file untouched
+run_test "POST conflict keeps content" "curl -s -i $BASE_URL/files/post.txt" "200" "original"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/post.txt
+
+# Metadata tests
+echo -e "${BLUE}Metadata Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/meta.txt -d 'twelve bytes'
+
+# Test 124: File metadata
+run_test "File metadata" "curl -s -i '$BASE_URL/files/meta.txt?meta=1'" "200" "\{\"name\":\"meta.txt\",\"size\":12,\"modified\":\"[^\"]+\",\"content_type\":\"text/plain; charset=utf-8\"\}"
+
+# Test 125: Missing file metadata
+run_test "Missing file metadata" "curl -s -i '$BASE_URL/files/absent.txt?meta=1'" "404" "File not found"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/meta.txt
+
+curl -s -o /dev/null -X PUT $BASE_URL/files/custom-blob -H 'Content-Type: application/x-custom' -d 'custom'
+curl -s -o /dev/null -X POST "$BASE_URL/files/query-blob?content_type=application/vnd.example%2Bjson" -d '{}'
+
+# Test 126: Uploaded Content-Type is served back for an extensionless file
+run_test "Upload content type header" "curl -s -i $BASE_URL/files/custom-blob" "200" "Content-Type: application/x-custom"
+
+# Test 127: Content type given as a query parameter
+run_test "Upload content type query" "curl -s -i $BASE_URL/files/query-blob" "200" "Content-Type: application/vnd.example\+json"
+
+# Test 128: Metadata reports the uploaded content type
+run_test "Upload content type metadata" "curl -s -i '$BASE_URL/files/custom-blob?meta=1'" "200" "\"content_type\":\"application/x-custom\""
+
+curl -s -o /dev/null -X PUT $BASE_URL/files/custom-blob -d 'plain again'
+
+# Test 129: Replacing the file without a type forgets the stored one
+run_test "Upload content type forgotten" "curl -s -i $BASE_URL/files/custom-blob" "200" "Content-Type: text/plain"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/custom-blob
+curl -s -o /dev/null -X DELETE $BASE_URL/files/query-blob
+
+curl -s -o /dev/null -X POST "$BASE_URL/files/my%20report%20%C3%BC.txt" -d 'report'
+
+# Test 130: Download with a space and a unicode character in the name
+run_test "Content-Disposition download" "curl -s -i '$BASE_URL/files/my%20report%20%C3%BC.txt?download=1'" "200" "Content-Disposition: attachment; filename=\"my report _.txt\"; filename\*=UTF-8''my%20report%20%C3%BC.txt"
+
+curl -s -o /dev/null -X DELETE "$BASE_URL/files/my%20report%20%C3%BC.txt"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/plain-report.txt -d 'report'
+
+# Test 131: ASCII names need no extended filename parameter
+run_test "Content-Disposition ASCII download" "curl -s -i '$BASE_URL/files/plain-report.txt?download=1'" "200" "Content-Disposition: attachment; filename=\"plain-report.txt\""$'\r'
+
+# Test 132: Without the download parameter the file is served inline
+run_test "No Content-Disposition without download" "curl -s -i $BASE_URL/files/plain-report.txt | grep -q Content-Disposition || echo inline" "" "^inline$"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/plain-report.txt
+
+# Test 133: PATCH creates a missing file
+run_test "PATCH creates file" "curl -s -i -X PATCH $BASE_URL/files/append.log -d 'one;'" "201" "\{\"name\":\"append.log\",\"size\":4\}"
+
+# Test 134: PATCH appends to an existing file and reports the new size
+run_test "PATCH appends" "curl -s -i -X PATCH $BASE_URL/files/append.log -d 'two;'" "200" "\"size\":8"
+
+curl -s -o /dev/null -X PATCH $BASE_URL/files/append.log -d 'three;'
+
+# Test 135: Appended content is concatenated
+run_test "PATCH concatenated content" "curl -s -i $BASE_URL/files/append.log" "200" "one;two;three;"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/append.log
+
+curl -s -o /dev/null -X POST $BASE_URL/files/tree/leaf.txt -d 'leaf'
+curl -s -o /dev/null -X POST $BASE_URL/files/tree/empty/placeholder.txt -d 'placeholder'
+
+# Test 136: Delete a file inside a directory
+run_test "Delete nested file" "curl -s -i -X DELETE $BASE_URL/files/tree/empty/placeholder.txt" "200" "File deleted"
+
+# Test 137: Delete an empty directory
+run_test "Delete empty directory" "curl -s -i -X DELETE $BASE_URL/files/tree/empty" "200" "Directory deleted"
+
+# Test 138: Delete a non-empty directory without the recursive flag
+run_test "Delete non-empty directory" "curl -s -i -X DELETE $BASE_URL/files/tree" "409" "Directory not empty"
+
+# Test 139: Delete a non-empty directory recursively
+run_test "Delete directory recursively" "curl -s -i -X DELETE '$BASE_URL/files/tree?recursive=1'" "200" "Directory deleted"
+
+# Streaming tests
+echo -e "${BLUE}Streaming Tests${NC}"
+echo "-------------------------------------------"
+
+stream_file=$(mktemp)
+head -c 5242880 /dev/urandom > "$stream_file"
+expected_sum=$(sha256sum < "$stream_file" | cut -d' ' -f1)
+curl -s -o /dev/null -X POST $BASE_URL/files/stream.bin --data-binary @"$stream_file"
+
+# Test 140: Large file is streamed intact
+run_test "Stream large file" "curl -s $BASE_URL/files/stream.bin | sha256sum" "" "$expected_sum"
+
+# Test 141: Large file is streamed intact with gzip
+run_test "Stream large file gzipped" "curl -s --compressed $BASE_URL/files/stream.bin | sha256sum" "" "$expected_sum"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/stream.bin
+rm -f "$stream_file"
+
+large_json=$(mktemp)
+printf '{"data":"%s"}' "$(head -c 200000 /dev/zero | tr '\0' 'a')" > "$large_json"
+large_json_sum=$(sha256sum < "$large_json")
+
+# Test 142: A large in-memory response is compressed as a chunked stream
+run_test "Large response streamed gzipped" "curl -s --compressed -D - -o /dev/null -X POST $BASE_URL/api/echo -H 'Content-Type: application/json' --data-binary @$large_json" "200" "Transfer-Encoding: chunked"
+
+# Test 143: The streamed response decompresses to the original body
+run_test "Large response gzip integrity" "curl -s --compressed -X POST $BASE_URL/api/echo -H 'Content-Type: application/json' --data-binary @$large_json | sha256sum" "" "$large_json_sum"
+
+rm -f "$large_json"
+
+sidecar_file=$(mktemp)
+printf 'precompressed css' | gzip > "$sidecar_file"
+curl -s -o /dev/null -X PUT $BASE_URL/files/sidecar.css -d 'body { color: red; }'
+curl -s -o /dev/null -X PUT $BASE_URL/files/sidecar.css.gz --data-binary @"$sidecar_file"
+curl -s -o /dev/null -X PUT $BASE_URL/files/nosidecar.css -d 'body { color: blue; }'
+
+# Test 144: A .gz sidecar is sent as is, with the original file's content type
+run_test "Gzip sidecar headers" "curl -s -D - -o /dev/null -H 'Accept-Encoding: gzip' $BASE_URL/files/sidecar.css" "200" "Content-Encoding: gzip.*Content-Type: text/css|Content-Type: text/css.*Content-Encoding: gzip"
+
+# Test 145: The sidecar's content is what gets decompressed
+run_test "Gzip sidecar content" "curl -s --compressed $BASE_URL/files/sidecar.css" "" "^precompressed css$"
+
+# Test 146: Clients without gzip get the original file
+run_test "Gzip sidecar skipped without gzip" "curl -s -i $BASE_URL/files/sidecar.css" "200" "body \{ color: red; \}"
+
+# Test 147: Without a sidecar the file is compressed on the fly
+run_test "Gzip without sidecar" "curl -s --compressed -D - $BASE_URL/files/nosidecar.css" "200" "Content-Encoding: gzip.*body \{ color: blue; \}"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/sidecar.css
+curl -s -o /dev/null -X DELETE $BASE_URL/files/sidecar.css.gz
+curl -s -o /dev/null -X DELETE $BASE_URL/files/nosidecar.css
+rm -f "$sidecar_file"
+
+# WebSocket tests
+echo -e "${BLUE}WebSocket Tests${NC}"
+echo "-------------------------------------------"
+
+ws_handshake='GET /ws HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n'
+# A masked text frame "hi", an empty ping and a close frame with status 1000
+ws_frames='\x81\x82\x01\x02\x03\x04\x69\x6b\x89\x80\x00\x00\x00\x00\x88\x82\x00\x00\x00\x00\x03\xe8'
+
+# Test 148: The handshake answers 101 with the accept key derived from the client's key
+run_test "WebSocket handshake" "raw_request '$ws_handshake$ws_frames' | tr -d '\\000-\\010\\201-\\377'" "101" "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK\+xOo="
+
+# Test 149: The text frame is echoed, the ping answered with a pong and the close acknowledged
+run_test "WebSocket echo" "raw_request '$ws_handshake$ws_frames' | tail -c 10 | od -An -tx1 | tr -d ' \\n'" "" "^810268698a00880203e8$"
+
+# Test 150: Only version 13 is spoken
+run_test "WebSocket unsupported version" "curl -s -i $BASE_URL/ws -H 'Upgrade: websocket' -H 'Connection: Upgrade' -H 'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==' -H 'Sec-WebSocket-Version: 8'" "426" "Sec-WebSocket-Version: 13"
+
+# Test 151: A plain GET is not an upgrade
+run_test "WebSocket without upgrade" "curl -s -i $BASE_URL/ws" "400" "not a WebSocket upgrade request"
+
+# Bulk delete tests
+echo -e "${BLUE}Bulk Delete Tests${NC}"
+echo "-------------------------------------------"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/bulk1.txt -d 'one'
+curl -s -o /dev/null -X POST $BASE_URL/files/bulk/two.txt -d 'two'
+
+# Test 152: Deleting everything requires confirmation
+run_test "Bulk delete unconfirmed" "curl -s -i -X DELETE $BASE_URL/files" "400" "X-Confirm-Delete"
+
+# Test 153: Unconfirmed bulk delete keeps the files
+run_test "Bulk delete unconfirmed keeps files" "curl -s -i $BASE_URL/files/bulk1.txt" "200" "one"
+
+# Test 154: Confirmed bulk delete
+run_test "Bulk delete confirmed" "curl -s -i -X DELETE $BASE_URL/files -H 'X-Confirm-Delete: true'" "200" "Deleted [0-9]+ entries"
+
+# Test 155: Files directory is empty afterwards
+run_test "Bulk delete empties store" "curl -s $BASE_URL/files/ -H 'Accept: application/json'" "" "^\[\]$"
+
+curl -s -o /dev/null -X POST $BASE_URL/files/bulk3.txt -d 'three'
+
+# Test 155a: An encoded slash naming the files root still needs confirmation
+run_test "Bulk delete via %2f" "curl -s -i -X DELETE '$BASE_URL/files/%2f?recursive=1'" "400" "X-Confirm-Delete"
+
+# Test 155b: So does an upper-case %2F
+run_test "Bulk delete via %2F" "curl -s -i -X DELETE '$BASE_URL/files/%2F?recursive=1'" "400" "X-Confirm-Delete"
+
+# Test 155c: And a dot segment
+run_test "Bulk delete via ./" "curl -s -i --path-as-is -X DELETE '$BASE_URL/files/./?recursive=1'" "400" "X-Confirm-Delete"
+
+# Test 155d: None of them removed anything
+run_test "Root-equivalent deletes keep files" "curl -s -i $BASE_URL/files/bulk3.txt" "200" "three"
+
+curl -s -o /dev/null -X DELETE $BASE_URL/files/bulk3.txt
+
+# TLS tests
+if [[ -n "$TLS_URL" ]]; then
+  echo -e "${BLUE}TLS Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Test 156: TLS handshake and GET /
+  run_test "TLS root endpoint" "curl -s -i -k $TLS_URL/" "200" "Welcome to the Go Web Server"
+  
+  # Test 157: HSTS over HTTPS
+  run_test "TLS HSTS header" "curl -s -i -k $TLS_URL/" "200" "Strict-Transport-Security: max-age="
+  
+  # Test 158: Secure session cookie over HTTPS
+  run_test "TLS secure cookie" "curl -s -i -k $TLS_URL/" "200" "Set-Cookie: session=[0-9a-f]+; Path=/; Secure"
+fi
+
+# Rate limit tests
+if [[ -n "$RATE_LIMIT_URL" ]]; then
+  echo -e "${BLUE}Rate Limit Tests${NC}"
+  echo "-------------------------------------------"
+  
+  curl -s -o /dev/null $RATE_LIMIT_URL/
+  curl -s -o /dev/null $RATE_LIMIT_URL/
+  
+  # Test 159: Requests beyond the burst are limited
+  run_test "Rate limit exceeded" "curl -s -i $RATE_LIMIT_URL/" "429" "Retry-After: [0-9]+"
+  
+  sleep 1
+  
+  # Test 160: Tokens refill after the window
+  run_test "Rate limit recovery" "curl -s -i $RATE_LIMIT_URL/" "200" "Welcome to the Go Web Server"
+fi
+
+# Disabled directory listing tests
+if [[ -n "$ALT_URL" ]]; then
+  echo -e "${BLUE}Disabled Directory Listing Tests${NC}"
+  echo "-------------------------------------------"
+  
+  curl -s -o /dev/null -X POST $ALT_URL/files/hidden.txt -d 'hidden'
+  
+  # Test 161: Listing the files root is forbidden
+  run_test "Directory listing disabled" "curl -s -i $ALT_URL/files/" "403" "Directory listing disabled"
+  
+  # Test 162: Files are still served
+  run_test "File served without listing" "curl -s -i $ALT_URL/files/hidden.txt" "200" "hidden"
+  
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/hidden.txt
+  
+  echo -e "${BLUE}File Cache Tests${NC}"
+  echo "-------------------------------------------"
+  
+  alt_metric() {
+    curl -s $ALT_URL/metrics | awk -v name="$1" '$1 == name {print $2}'
+  }
+  
+  curl -s -o /dev/null -X PUT $ALT_URL/files/cached.txt -d 'cached v1'
+  misses_before=$(alt_metric http_file_cache_misses_total)
+  curl -s -o /dev/null $ALT_URL/files/cached.txt
+  hits_before=$(alt_metric http_file_cache_hits_total)
+  
+  # Test 163: The first read misses the cache
+  run_test "File cache miss" "echo \$(( \$(alt_metric http_file_cache_misses_total) - misses_before ))" "" "^1$"
+  
+  # Test 164: The second read is served from the cache
+  run_test "File cache hit" "curl -s $ALT_URL/files/cached.txt; echo; echo hits=\$(( \$(alt_metric http_file_cache_hits_total) - hits_before ))" "" "cached v1.hits=1"
+  
+  sleep 0.01
+  curl -s -o /dev/null -X PUT $ALT_URL/files/cached.txt -d 'cached v2'
+  misses_before=$(alt_metric http_file_cache_misses_total)
+  
+  # Test 165: A modified file invalidates its cached copy
+  run_test "File cache invalidation" "curl -s $ALT_URL/files/cached.txt; echo; echo misses=\$(( \$(alt_metric http_file_cache_misses_total) - misses_before ))" "" "cached v2.misses=1"
+  
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/cached.txt
+  
+  # The cache holds 64 bytes, so two 40-byte files can't both stay cached
+  curl -s -o /dev/null -X PUT $ALT_URL/files/evict-a.txt -d 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa'
+  curl -s -o /dev/null -X PUT $ALT_URL/files/evict-b.txt -d 'bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb'
+  curl -s -o /dev/null $ALT_URL/files/evict-a.txt
+  evictions_before=$(alt_metric http_file_cache_evictions_total)
+  curl -s -o /dev/null $ALT_URL/files/evict-b.txt
+  
+  # Test 166: Caching a file over the budget evicts the least recently used one
+  run_test "File cache eviction" "echo evictions=\$(( \$(alt_metric http_file_cache_evictions_total) - evictions_before )) bytes=\$(alt_metric http_file_cache_bytes)" "" "^evictions=1 bytes=40$"
+  
+  misses_before=$(alt_metric http_file_cache_misses_total)
+  
+  # Test 167: The evicted file is read from disk again
+  run_test "File cache evicted entry missed" "curl -s $ALT_URL/files/evict-a.txt; echo; echo misses=\$(( \$(alt_metric http_file_cache_misses_total) - misses_before ))" "" "a{40}.misses=1"
+  
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/evict-a.txt
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/evict-b.txt
+  
+  echo -e "${BLUE}Request Line Limit Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Test 167a: The configured cap allows shorter request lines
+  run_test "Configured request line cap within" "curl -s -i $ALT_URL/echo/$(printf 'b%.0s' {1..150})" "200" "Content-Length: 150"
+  
+  # Test 167b: The configured cap rejects longer ones
+  run_test "Configured request line cap exceeded" "curl -s -i $ALT_URL/echo/$(printf 'b%.0s' {1..250})" "414" "URI Too Long"
+  
+  echo -e "${BLUE}Static Cache Control Tests${NC}"
+  echo "-------------------------------------------"
+  
+  curl -s -o /dev/null -X PUT $ALT_URL/files/page.txt -d 'cache control'
+  curl -s -o /dev/null -X PUT $ALT_URL/files/app.3f9a2b7c.js -d 'console.log(1)'
+  page_etag=$(curl -s -D - -o /dev/null $ALT_URL/files/page.txt | grep -i '^ETag:' | cut -d' ' -f2 | tr -d '\r')
+  
+  # Test 167c: Files carry the configured Cache-Control
+  run_test "Static Cache-Control" "curl -s -i $ALT_URL/files/page.txt" "200" "Cache-Control: public, max-age=3600"
+  
+  # Test 167d: Revalidation responses carry it too
+  run_test "Static Cache-Control on 304" "curl -s -i $ALT_URL/files/page.txt -H 'If-None-Match: $page_etag'" "304" "Cache-Control: public, max-age=3600"
+  
+  # Test 167e: Fingerprinted files are cached for a year without revalidation
+  run_test "Immutable fingerprinted asset" "curl -s -i $ALT_URL/files/app.3f9a2b7c.js" "200" "Cache-Control: public, max-age=31536000, immutable"
+  
+  # Test 167f: Embedded assets get the configured Cache-Control as well
+  run_test "Static Cache-Control on embedded asset" "curl -s -i $ALT_URL/static/style.css" "200" "Cache-Control: public, max-age=3600"
+  
+  curl -s -o /dev/null -X PUT $BASE_URL/files/page.txt -d 'page'
+  
+  # Test 167g: Nothing is sent unless configured
+  run_test "No Cache-Control by default" "curl -s -i $BASE_URL/files/page.txt | grep -ci '^Cache-Control:' || true" "" "^0$"
+  
+  curl -s -o /dev/null -X DELETE $BASE_URL/files/page.txt
+  
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/page.txt
+  curl -s -o /dev/null -X DELETE $ALT_URL/files/app.3f9a2b7c.js
+  
+  echo -e "${BLUE}Delay Cap Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Test 168: Delays beyond the configured maximum are capped
+  run_test "API delay capped" "curl -s -i -w ' %{time_total}' $ALT_URL/api/delay/30" "200" "\"capped\":true,\"delay\":1\} 1\.[0-9]"
+  
+  echo -e "${BLUE}Event Stream Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Test 169: Event streams are uncompressed, uncached and end with the connection
+  run_test "Event stream headers" "curl -s -i --compressed '$ALT_URL/api/events?count=1'" "200" "Content-Type: text/event-stream"
+  
+  # Test 170: The subscriber gets both events and a heartbeat in between, then the stream ends cleanly
+  run_test "Event stream events and heartbeat" "curl -sN '$ALT_URL/api/events?count=2' | tr -d '\r' | awk '/^data: / {d++} /^: heartbeat$/ {h++} END {print \"events=\" d, \"heartbeat=\" (h > 0)}'; echo exit=\${PIPESTATUS[0]}" "" "^events=2 heartbeat=1.exit=0$"
+  
+  # Test 171: A subscriber hanging up ends the stream and frees its connection
+  active_before=$(alt_metric http_active_connections)
+  curl -sN --max-time 1 -o /dev/null $ALT_URL/api/events
+  sleep 0.2
+  run_test "Event stream client disconnect" "echo delta=\$(( \$(alt_metric http_active_connections) - active_before ))" "" "^delta=0$"
+  
+  echo -e "${BLUE}Connection Limit Tests${NC}"
+  echo "-------------------------------------------"
+  
+  pipelined_gets=""
+  for word in one two three four; do
+    pipelined_gets+="GET /echo/$word HTTP/1.1\r\nHost: localhost\r\n\r\n"
+  done
+  
+  # Test 172: Only the allowed number of pipelined requests is answered
+  run_test "Max requests per connection" "raw_request '$pipelined_gets' $ALT_PORT | grep -o 'HTTP/1.1 200' | wc -l" "" "^3$"
+  
+  # Test 173: Only the last allowed response announces the close
+  run_test "Max requests last response closes" "raw_request '$pipelined_gets' $ALT_PORT | tr -d '\r' | grep -o 'Connection: close\|^three' | tr '\n' ' '" "" "^Connection: close three $"
+  
+  idle_start=$(date +%s%N)
+  raw_request 'GET / HTTP/1.1\r\nHost: localhost\r\n\r\n' $ALT_PORT > /dev/null
+  idle_ms=$(( ($(date +%s%N) - idle_start) / 1000000 ))
+  
+  # Test 174: A keep-alive connection is closed once it idles past --idle-timeout
+  run_test "Idle timeout closes connection" "(( idle_ms >= 900 && idle_ms < 1900 )) && echo closed after \${idle_ms}ms" "" "^closed after"
+  
+  # Test 175: The configured idle timeout is announced
+  run_test "Idle timeout announced" "curl -s -i $ALT_URL/" "200" "Keep-Alive: timeout=1"
+  
+  # Test 176: Configured security header overrides the default
+  run_test "Security header override" "curl -s -i $ALT_URL/" "200" "X-Frame-Options: SAMEORIGIN"
+  
+  # Test 177: Configured HTML-only headers are added to HTML responses, without overriding headers set for all
+  run_test "HTML security header override" "curl -s -i $ALT_URL/static/ | grep -i 'X-Frame-Options\|Referrer-Policy' | tr -d '\r' | sort | tr '\n' ' '" "" "^Referrer-Policy: no-referrer X-Frame-Options: SAMEORIGIN $"
+  
+  # Test 178: HTML-only headers stay off plain text responses
+  run_test "HTML security header skips text" "curl -s -i $ALT_URL/ | grep -ci Referrer-Policy || true" "" "^0$"
+  
+  echo -e "${BLUE}CORS Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Test 179: Preflight from an allowed origin
+  run_test "CORS preflight" "curl -s -i -X OPTIONS $ALT_URL/api/echo -H 'Origin: https://app.example.com' -H 'Access-Control-Request-Method: POST'" "204" "Access-Control-Allow-Methods: [A-Z, ]*POST"
+  
+  # Test 180: Simple cross-origin GET echoes the allowed origin
+  run_test "CORS simple GET" "curl -s -i $ALT_URL/api/time -H 'Origin: https://app.example.com'" "200" "Access-Control-Allow-Origin: https://app.example.com"
+  
+  # Test 181: Other origins get no CORS headers but still vary on Origin
+  run_test "CORS disallowed origin" "curl -s -i $ALT_URL/api/time -H 'Origin: https://evil.example.com'" "200" "Vary: Origin"
+fi
+
+# Environment configuration tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Environment Configuration Tests${NC}"
+  echo "-------------------------------------------"
+  
+  env_dir=$(mktemp -d)
+  HTTP_PORT=$SHUTDOWN_PORT HTTP_DIRECTORY="$env_dir" HTTP_ENABLE_DIRECTORY_LISTING=false "$SERVER_BIN" > /dev/null 2>&1 &
+  env_pid=$!
+  sleep 0.5
+  
+  # Test 182: Port and directory come from the environment when no flag is given
+  run_test "Environment sets port" "curl -s -i http://$HOST:$SHUTDOWN_PORT/" "200" "Welcome to the Go Web Server"
+  
+  # Test 183: Boolean settings come from the environment too
+  run_test "Environment disables listing" "curl -s -i http://$HOST:$SHUTDOWN_PORT/files/" "403" "Directory listing disabled"
+  
+  kill $env_pid; wait $env_pid 2>/dev/null
+  
+  HTTP_PORT=1 HTTP_DIRECTORY="$env_dir" "$SERVER_BIN" --port $SHUTDOWN_PORT > /dev/null 2>&1 &
+  env_pid=$!
+  sleep 0.5
+  
+  # Test 184: Flags take precedence over the environment
+  run_test "Flag overrides environment" "curl -s -i http://$HOST:$SHUTDOWN_PORT/" "200" "Welcome to the Go Web Server"
+  
+  kill $env_pid; wait $env_pid 2>/dev/null
+  
+  # Test 185: Malformed values are rejected at startup
+  run_test "Invalid environment value" "HTTP_MAX_CONNECTIONS=lots \"$SERVER_BIN\" --directory $env_dir --port $SHUTDOWN_PORT 2>&1; echo exit=\$?" "" "invalid HTTP_MAX_CONNECTIONS.*exit=1"
+  
+  # Test 185a: Malformed flag values are rejected at startup too
+  run_test "Invalid upload size flag" "\"$SERVER_BIN\" --directory $env_dir --port $SHUTDOWN_PORT --max-upload-size 10MB 2>&1; echo exit=\$?" "" "Invalid --max-upload-size.*exit=1"
+  
+  rm -rf "$env_dir"
+fi
+
+# Bind address tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Bind Address Tests${NC}"
+  echo "-------------------------------------------"
+  
+  bind_dir=$(mktemp -d)
+  "$SERVER_BIN" --directory "$bind_dir" --host 127.0.0.1 --port $SHUTDOWN_PORT > /dev/null 2>&1 &
+  bind_pid=$!
+  sleep 0.5
+  
+  # Test 186: The server answers on the address it was bound to
+  run_test "Bind to loopback" "curl -s -i http://127.0.0.1:$SHUTDOWN_PORT/" "200" "Welcome to the Go Web Server"
+  
+  # Test 187: It doesn't answer on the machine's other addresses
+  other_ip=$(hostname -I 2>/dev/null | tr ' ' '\n' | grep -m1 -E '^[0-9.]+$' | grep -v '^127\.')
+  if [[ -n "$other_ip" ]]; then
+    run_test "Bind excludes other interfaces" "curl -s --max-time 1 http://$other_ip:$SHUTDOWN_PORT/ || echo unreachable" "" "^unreachable$"
+  fi
+  
+  kill $bind_pid; wait $bind_pid 2>/dev/null
+  
+  # Test 188: IPv6 literals are bracketed correctly in the listen address
+  if grep -qs . /proc/net/if_inet6; then
+    "$SERVER_BIN" --directory "$bind_dir" --host ::1 --port $SHUTDOWN_PORT > /dev/null 2>&1 &
+    bind_pid=$!
+    sleep 0.5
+    run_test "Bind to IPv6 loopback" "curl -s -i 'http://[::1]:$SHUTDOWN_PORT/'" "200" "Welcome to the Go Web Server"
+    kill $bind_pid; wait $bind_pid 2>/dev/null
+  fi
+  
+  rm -rf "$bind_dir"
+fi
+
+# Reverse proxy tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Reverse Proxy Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # The server under test stands in as the upstream
+  proxy_dir=$(mktemp -d)
+  PROXY_URL="http://$HOST:$SHUTDOWN_PORT"
+  "$SERVER_BIN" --directory "$proxy_dir" --port $SHUTDOWN_PORT --proxy /backend=$BASE_URL/api --proxy /down=http://127.0.0.1:1 > /dev/null 2>&1 &
+  proxy_pid=$!
+  sleep 0.5
+  
+  # Test 189: The prefix is rewritten to the upstream path and the response relayed
+  run_test "Proxy forwards request" "curl -s -i '$PROXY_URL/backend/anything?x=1'" "200" '"path":"/api/anything".*"query":\{"x":\["1"\]\}'
+  
+  # Test 190: The upstream sees its own Host and the client appended to X-Forwarded-For
+  run_test "Proxy forwarded headers" "curl -s $PROXY_URL/backend/anything -H 'X-Forwarded-For: 203.0.113.7'" "" "\"Host\":\[\"$HOST:$PORT\"\].*\"X-Forwarded-For\":\[\"203\\.0\\.113\\.7, [0-9a-f.:]+\"\]"
+  
+  # Test 191: Hop-by-hop headers, including those named in Connection, are not forwarded
+  run_test "Proxy strips hop-by-hop headers" "curl -s $PROXY_URL/backend/anything -H 'Connection: X-Hop' -H 'X-Hop: secret' -H 'Keep-Alive: timeout=5' | grep -q 'X-Hop\\|Keep-Alive' || echo stripped" "" "^stripped$"
+  
+  # Test 192: Request bodies are sent upstream
+  run_test "Proxy relays request body" "curl -s -i -X POST $PROXY_URL/backend/echo -H 'Content-Type: application/json' -d '{\"proxied\":true}'" "200" '\{"proxied":true\}'
+  
+  # Test 193: Upstream error statuses are passed through
+  run_test "Proxy relays upstream status" "curl -s -i $PROXY_URL/backend/status/418" "418" "I'm a teapot"
+  
+  # Test 195: An unreachable upstream is a 502
+  run_test "Proxy unreachable upstream" "curl -s -i $PROXY_URL/down/anything" "502" "Bad Gateway"
+  
+  kill $proxy_pid; wait $proxy_pid 2>/dev/null
+  rm -rf "$proxy_dir"
+fi
+
+# Index file tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Index File Tests${NC}"
+  echo "-------------------------------------------"
+  
+  index_dir=$(mktemp -d)
+  INDEX_URL="http://$HOST:$SHUTDOWN_PORT"
+  printf '<!DOCTYPE html><title>Home</title><h1>My site</h1>' > "$index_dir/index.html"
+  "$SERVER_BIN" --directory "$index_dir" --port $SHUTDOWN_PORT --index-file index.html > /dev/null 2>&1 &
+  index_pid=$!
+  sleep 0.5
+  
+  # Test 196: The configured index file is served at /
+  run_test "Index file served at root" "curl -s -i $INDEX_URL/" "200" "Content-Type: text/html.*<h1>My site</h1>"
+  
+  # Test 197: It revalidates like any other file
+  index_etag=$(curl -s -D - -o /dev/null $INDEX_URL/ | grep -i '^ETag:' | cut -d' ' -f2 | tr -d '\r')
+  run_test "Index file If-None-Match" "curl -s -i $INDEX_URL/ -H 'If-None-Match: $index_etag'" "304" "ETag:"
+  
+  rm "$index_dir/index.html"
+  
+  # Test 198: Without the file, / falls back to the welcome message
+  run_test "Index file absent" "curl -s -i $INDEX_URL/" "200" "Welcome to the Go Web Server"
+  
+  kill $index_pid; wait $index_pid 2>/dev/null
+  rm -rf "$index_dir"
+fi
+
+# Truncated body tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Truncated Body Tests${NC}"
+  echo "-------------------------------------------"
+  
+  truncated_dir=$(mktemp -d)
+  truncated_log=$(mktemp)
+  TRUNCATED_URL="http://$HOST:$SHUTDOWN_PORT"
+  "$SERVER_BIN" --directory "$truncated_dir" --port $SHUTDOWN_PORT > "$truncated_log" 2>&1 &
+  truncated_pid=$!
+  sleep 0.5
+  
+  # The client promises 1000 bytes but hangs up after 200
+  exec 3<>/dev/tcp/$HOST/$SHUTDOWN_PORT
+  printf "PUT /files/truncated.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1000\r\n\r\n%s" "$(printf 'x%.0s' {1..200})" >&3
+  exec 3>&-
+  sleep 0.5
+  
+  # Test 198a: The truncated upload is dropped rather than stored
+  run_test "Truncated body not stored" "curl -s -i $TRUNCATED_URL/files/truncated.txt" "404" "File not found"
+  
+  # Test 198b: The dropped request is logged with how much of the body arrived
+  run_test "Truncated body logged" "cat $truncated_log" "" "Dropping PUT /files/truncated.txt from [^ ]+: client closed the connection after 200 of 1000 body bytes"
+  
+  # Test 198c: A chunked body cut short is dropped too
+  exec 3<>/dev/tcp/$HOST/$SHUTDOWN_PORT
+  printf "PUT /files/truncated.txt HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n64\r\nonly part of it" >&3
+  exec 3>&-
+  sleep 0.5
+  run_test "Truncated chunked body logged" "cat $truncated_log" "" "client closed the connection after [0-9]+ bytes of a chunked body"
+  
+  # Test 198d: The server keeps serving other clients
+  run_test "Server survives truncated body" "curl -s -i -X PUT $TRUNCATED_URL/files/truncated.txt -d 'complete'" "201" "File created"
+  
+  kill $truncated_pid; wait $truncated_pid 2>/dev/null
+  rm -rf "$truncated_dir" "$truncated_log"
+fi
+
+# Virtual host tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Virtual Host Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Each host is served from its own path on the server under test
+  vhost_dir=$(mktemp -d)
+  VHOST_URL="http://$HOST:$SHUTDOWN_PORT"
+  "$SERVER_BIN" --directory "$vhost_dir" --port $SHUTDOWN_PORT --vhost a.test=$BASE_URL/echo/site-a --vhost b.test=$BASE_URL/echo/site-b > /dev/null 2>&1 &
+  vhost_pid=$!
+  sleep 0.5
+  
+  # Test 199: Each virtual host answers the same path with its own response
+  run_test "Virtual host routing" "curl -s $VHOST_URL/page -H 'Host: a.test'; echo; curl -s $VHOST_URL/page -H 'Host: b.test'" "" "^site-a/page.site-b/page$"
+  
+  # Test 200: Hosts match case-insensitively and without the port
+  run_test "Virtual host case and port" "curl -s -i $VHOST_URL/page -H 'Host: A.Test:$SHUTDOWN_PORT'" "200" "site-a/page"
+  
+  # Test 201: Other hosts fall back to the server's own routes
+  run_test "Virtual host fallback" "curl -s -i $VHOST_URL/" "200" "Welcome to the Go Web Server"
+  
+  kill $vhost_pid; wait $vhost_pid 2>/dev/null
+  rm -rf "$vhost_dir"
+fi
+
+# Trusted proxy tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Trusted Proxy Tests${NC}"
+  echo "-------------------------------------------"
+  
+  # Loopback is trusted here, so the test's own requests count as coming from a proxy
+  trusted_dir=$(mktemp -d)
+  trusted_log=$(mktemp)
+  TRUSTED_URL="http://$HOST:$SHUTDOWN_PORT"
+  "$SERVER_BIN" --directory "$trusted_dir" --port $SHUTDOWN_PORT --trusted-proxy 127.0.0.0/8 --trusted-proxy ::1 --rate-limit 0.2 --rate-burst 1 --log-format json > "$trusted_log" 2>&1 &
+  trusted_pid=$!
+  sleep 0.5
+  
+  # Test 202: The client IP comes from X-Forwarded-For sent by a trusted peer
+  run_test "Trusted proxy client IP" "curl -s -i $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 203.0.113.7'" "200" '"origin":"203\.0\.113\.7"'
+  
+  # Test 203: Entries left of the first untrusted one may be spoofed and are ignored
+  run_test "Trusted proxy ignores spoofed entries" "curl -s $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 1.1.1.1, 203.0.113.8'" "" '"origin":"203\.0\.113\.8"'
+  
+  # Test 204: Trusted hops are skipped on the way to the client
+  run_test "Trusted proxy skips trusted hops" "curl -s $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 203.0.113.9, 127.0.0.5'" "" '"origin":"203\.0\.113\.9"'
+  
+  # Test 205: The access log records the forwarded client IP
+  run_test "Trusted proxy access log" "cat $trusted_log" "" '"remote_ip":"203\.0\.113\.7"'
+  
+  # Test 206: Each forwarded client gets its own rate limit bucket
+  run_test "Trusted proxy rate limits per client" "curl -s -o /dev/null -w '%{http_code} ' $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 203.0.113.7'; curl -s -o /dev/null -w '%{http_code}' $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 203.0.113.10'" "" "^429 200$"
+  
+  kill $trusted_pid; wait $trusted_pid 2>/dev/null
+  
+  # --trust-proxy trusts loopback and private peers without listing them
+  "$SERVER_BIN" --directory "$trusted_dir" --port $SHUTDOWN_PORT --trust-proxy > /dev/null 2>&1 &
+  trusted_pid=$!
+  sleep 0.5
+  
+  # Test 207: Loopback peers are trusted, and spoofed entries still ignored
+  run_test "Trust proxy spoofed chain" "curl -s $TRUSTED_URL/api/anything -H 'X-Forwarded-For: 1.1.1.1, 203.0.113.11, 10.0.0.3'" "" '"origin":"203\.0\.113\.11"'
+  
+  # Test 208: X-Real-IP from a trusted proxy is used when there is no X-Forwarded-For
+  run_test "Trust proxy X-Real-IP" "curl -s $TRUSTED_URL/api/anything -H 'X-Real-IP: 203.0.113.12'" "" '"origin":"203\.0\.113\.12"'
+  
+  kill $trusted_pid; wait $trusted_pid 2>/dev/null
+  rm -rf "$trusted_dir" "$trusted_log"
+  
+  # Test 209: The main server trusts no proxies, so X-Forwarded-For is ignored
+  run_test "Untrusted peer X-Forwarded-For ignored" "curl -s $BASE_URL/api/anything -H 'X-Forwarded-For: 203.0.113.7'" "" '"origin":"(127\.0\.0\.1|::1)"'
+  
+  # Test 210: So is X-Real-IP
+  run_test "Untrusted peer X-Real-IP ignored" "curl -s $BASE_URL/api/anything -H 'X-Real-IP: 203.0.113.12'" "" '"origin":"(127\.0\.0\.1|::1)"'
+fi
+
+# Graceful shutdown tests
+if [[ -n "$SERVER_BIN" ]]; then
+  echo -e "${BLUE}Graceful Shutdown Tests${NC}"
+  echo "-------------------------------------------"
+  
+  shutdown_dir=$(mktemp -d)
+  "$SERVER_BIN" --directory "$shutdown_dir" --port $SHUTDOWN_PORT --shutdown-timeout 5s > /dev/null 2>&1 &
+  shutdown_pid=$!
+  sleep 0.5
+  
+  # Leave one keep-alive connection idle and send another request's headers,
+  # then signal the server while that request's body is still outstanding.
+  # New connections are tried before the body is sent and the response read.
+  inflight_request() {
+    exec 5<>/dev/tcp/$HOST/$SHUTDOWN_PORT
+    printf "GET / HTTP/1.1\r\nHost: $HOST\r\n\r\n" >&5
+    exec 4<>/dev/tcp/$HOST/$SHUTDOWN_PORT
+    printf "POST /files/inflight.txt HTTP/1.1\r\nHost: $HOST\r\nContent-Length: 8\r\n\r\n" >&4
+    sleep 0.2
+    kill -TERM $shutdown_pid
+    sleep 0.2
+    curl -s -o /dev/null --max-time 1 http://$HOST:$SHUTDOWN_PORT/ || echo "new connection refused"
+    timeout 1 cat <&5 > /dev/null && echo "idle connection closed"
+    exec 5<&-
+    printf "inflight" >&4
+    timeout 2 cat <&4
+    exec 4<&-
+  }
+  shutdown_output=$(inflight_request)
+  
+  # Test 211: A request in flight when the signal arrives still completes, and is the connection's last
+  run_test "Shutdown completes in-flight request" "echo \"\$shutdown_output\"" "201" "Connection: close"
+  
+  # Test 212: New connections are refused once shutdown begins
+  run_test "Shutdown refuses new connections" "echo \"\$shutdown_output\"" "" "new connection refused"
+  
+  # Test 213: Idle keep-alive connections are closed right away
+  run_test "Shutdown closes idle connections" "echo \"\$shutdown_output\"" "" "idle connection closed"
+  
+  # Test 214: The server exits cleanly once the connection is done
+  run_test "Shutdown exits cleanly" "wait $shutdown_pid; echo exit=\$?" "" "exit=0"
+  
+  # Test 215: The in-flight upload was written
+  run_test "Shutdown kept in-flight upload" "cat $shutdown_dir/files/inflight.txt" "" "^inflight$"
+  
+  "$SERVER_BIN" --directory "$shutdown_dir" --port $SHUTDOWN_PORT --shutdown-timeout 5s > /dev/null 2>&1 &
+  shutdown_pid=$!
+  sleep 0.5
+  curl -sN -o /dev/null http://$HOST:$SHUTDOWN_PORT/api/events &
+  events_pid=$!
+  sleep 0.5
+  
+  shutdown_start=$(date +%s%N)
+  kill -TERM $shutdown_pid
+  wait $shutdown_pid
+  shutdown_ms=$(( ($(date +%s%N) - shutdown_start) / 1000000 ))
+  
+  # Test 216: Open event streams end as soon as shutdown begins instead of holding it up
+  run_test "Shutdown ends event streams" "timeout 1 tail --pid=$events_pid -f /dev/null && echo stream ended; (( shutdown_ms < 2000 )) && echo promptly" "" "^stream ended.promptly$"
+  
+  rm -rf "$shutdown_dir"
+fi
 
 # Summary
 echo "==========================================="
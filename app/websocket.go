@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept (RFC 6455 section 1.3)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWSMessageSize caps the size of a message ReadMessage will assemble
+const maxWSMessageSize = 1 << 20
+
+// WebSocket opcodes. Text and binary frames carry messages; the rest are control frames.
+const (
+	WSContinuation = 0x0
+	WSText         = 0x1
+	WSBinary       = 0x2
+	WSClose        = 0x8
+	WSPing         = 0x9
+	WSPong         = 0xA
+)
+
+// WebSocket close status codes (RFC 6455 section 7.4.1)
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseInvalidData   = 1007
+	wsCloseTooBig        = 1009
+)
+
+// errWSVersion is returned by Upgrade when the client speaks a WebSocket version
+// other than 13; the client should be told which version is supported
+var errWSVersion = errors.New("unsupported WebSocket version; only 13 is supported")
+
+// WSConn is a WebSocket connection. Reads must come from one goroutine at a time;
+// writes may come from several.
+type WSConn struct {
+	conn       net.Conn
+	reader     *bufio.Reader
+	writeMutex sync.Mutex
+}
+
+// Upgrade completes the opening handshake of RFC 6455 for a request's headers and
+// takes the connection over from the server. On error nothing has been sent, so the
+// caller can still answer with an HTTP error; errWSVersion calls for a 426 listing
+// version 13. The connection is closed once the handler returns.
+func Upgrade(conn net.Conn, headers map[string]string) (*WSConn, error) {
+	if responseProto(conn) == "HTTP/1.0" {
+		return nil, errors.New("WebSocket needs HTTP/1.1")
+	}
+	if !hasToken(headers["Connection"], "upgrade") || !hasToken(headers["Upgrade"], "websocket") {
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if headers["Sec-Websocket-Version"] != "13" {
+		return nil, errWSVersion
+	}
+	key := headers["Sec-Websocket-Key"]
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	
+	reader, err := hijackConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	
+	sum := sha1.Sum([]byte(key + wsGUID))
+	recordStatus(conn, 101)
+	head := getBuffer()
+	defer bufferPool.Put(head)
+	writeResponseHead(head, "HTTP/1.1", 101, "Switching Protocols", "", Header{
+		"Upgrade":              {"websocket"},
+		"Connection":           {"Upgrade"},
+		"Sec-WebSocket-Accept": {base64.StdEncoding.EncodeToString(sum[:])},
+	}, false)
+	head.WriteString("\r\n")
+	if _, err := conn.Write(head.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := flushConn(conn); err != nil {
+		return nil, err
+	}
+	return &WSConn{conn: conn, reader: reader}, nil
+}
+
+// Read message returns the next text or binary message, joining fragmented
+// messages. Pings are answered along the way. When the client closes the
+// connection, the close is acknowledged and io.EOF returned; protocol errors
+// close the connection with the matching status and are returned.
+func (ws *WSConn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		
+		switch frameOpcode {
+		case WSPing:
+			if err := ws.WriteMessage(WSPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case WSPong:
+			continue
+		case WSClose:
+			// Echo the client's status code back, as RFC 6455 section 5.5.1 suggests
+			if len(payload) >= 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(WSClose, payload)
+			ws.conn.Close()
+			return 0, nil, io.EOF
+		case WSContinuation:
+			if opcode == 0 {
+				return 0, nil, ws.fail(wsCloseProtocolError, "continuation frame without a message")
+			}
+		case WSText, WSBinary:
+			if opcode != 0 {
+				return 0, nil, ws.fail(wsCloseProtocolError, "new message before the last one finished")
+			}
+			opcode = frameOpcode
+		default:
+			return 0, nil, ws.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %#x", frameOpcode))
+		}
+		
+		if len(message)+len(payload) > maxWSMessageSize {
+			return 0, nil, ws.fail(wsCloseTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if opcode == WSText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(wsCloseInvalidData, "text message is not valid UTF-8")
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// Write message sends data in a single frame with the given opcode
+func (ws *WSConn) WriteMessage(opcode int, data []byte) error {
+	return ws.writeFrame(opcode, data)
+}
+
+// Close sends a normal close frame and closes the connection without waiting for
+// the client's reply
+func (ws *WSConn) Close() error {
+	ws.writeFrame(WSClose, closePayload(wsCloseNormal, ""))
+	return ws.conn.Close()
+}
+
+// Read frame reads one frame and unmasks its payload. Client frames must be masked,
+// and control frames must be final and at most 125 bytes.
+func (ws *WSConn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ws.fail(wsCloseProtocolError, "reserved bits set")
+	}
+	if !masked {
+		return false, 0, nil, ws.fail(wsCloseProtocolError, "client frames must be masked")
+	}
+	if opcode >= WSClose && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(wsCloseProtocolError, "invalid control frame")
+	}
+	
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxWSMessageSize {
+		return false, 0, nil, ws.fail(wsCloseTooBig, "message too big")
+	}
+	
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// Write frame sends a single unmasked, final frame, as servers do
+func (ws *WSConn) writeFrame(opcode int, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+	
+	frame := getBuffer()
+	defer bufferPool.Put(frame)
+	frame.WriteByte(0x80 | byte(opcode))
+	switch {
+	case len(payload) <= 125:
+		frame.WriteByte(byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame.WriteByte(126)
+		binary.Write(frame, binary.BigEndian, uint16(len(payload)))
+	default:
+		frame.WriteByte(127)
+		binary.Write(frame, binary.BigEndian, uint64(len(payload)))
+	}
+	frame.Write(payload)
+	
+	if _, err := ws.conn.Write(frame.Bytes()); err != nil {
+		return err
+	}
+	return flushConn(ws.conn)
+}
+
+// Fail closes the connection with a status code after a protocol error and
+// returns the error describing it
+func (ws *WSConn) fail(code int, reason string) error {
+	ws.writeFrame(WSClose, closePayload(code, reason))
+	ws.conn.Close()
+	return errors.New("websocket: " + reason)
+}
+
+// Close payload builds a close frame's body from a status code and reason
+func closePayload(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+// Handle WebSocket echo upgrades the connection and sends every message back to the client
+func (s *Server) handleWebSocketEcho(conn net.Conn, req *Request) {
+	ws, err := Upgrade(conn, req.Headers)
+	if errors.Is(err, errWSVersion) {
+		req.ResponseHeaders.Set("Sec-WebSocket-Version", "13")
+		writeError(conn, 426, err.Error(), req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	if err != nil {
+		writeError(conn, 400, err.Error(), req.ResponseHeaders, req.Headers["Accept"])
+		return
+	}
+	
+	for {
+		opcode, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(opcode, message); err != nil {
+			return
+		}
+	}
+}